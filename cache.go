@@ -5,23 +5,22 @@
 package core
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
 	"errors"
-	"fmt"
-	"strings"
 	"time"
 )
 
 const (
 	// default cache expired time
 	CacheExpired = 60 * time.Minute
-	// not use now
+	// default max memory in megabytes of a LRUStore
 	CacheMaxMemory = 256
 	// evey ten minutes to clear all expired nodes
 	CacheGcInterval = 10 * time.Minute
 	// each time when gc to removed max nodes
 	CacheGcMaxRemoved = 20
+	// default expired time of the entries recording a bean does not exist
+	CacheNegativeExpired = time.Minute
 )
 
 var (
@@ -52,40 +51,109 @@ type Cacher interface {
 	ClearBeans(tableName string)
 }
 
-func encodeIds(ids []PK) (string, error) {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(ids)
+// CacheStoreContext is the context aware variant of CacheStore
+type CacheStoreContext interface {
+	PutContext(ctx context.Context, key string, value interface{}) error
+	GetContext(ctx context.Context, key string) (interface{}, error)
+	DelContext(ctx context.Context, key string) error
+}
 
-	return buf.String(), err
+// CacherContext is the context and error aware variant of Cacher,
+// GetIdsContext and GetBeanContext return ErrCacheMiss when nothing is cached
+type CacherContext interface {
+	GetIdsContext(ctx context.Context, tableName, sql string) (interface{}, error)
+	GetBeanContext(ctx context.Context, tableName, id string) (interface{}, error)
+	PutIdsContext(ctx context.Context, tableName, sql string, ids interface{}) error
+	PutBeanContext(ctx context.Context, tableName, id string, obj interface{}) error
+	DelIdsContext(ctx context.Context, tableName, sql string) error
+	DelBeanContext(ctx context.Context, tableName, id string) error
+	ClearIdsContext(ctx context.Context, tableName string) error
+	ClearBeansContext(ctx context.Context, tableName string) error
 }
 
-func decodeIds(s string) ([]PK, error) {
-	pks := make([]PK, 0)
+func storeGet(ctx context.Context, store CacheStore, key string) (interface{}, error) {
+	if s, ok := store.(CacheStoreContext); ok {
+		return s.GetContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return store.Get(key)
+}
+
+func storePut(ctx context.Context, store CacheStore, key string, value interface{}) error {
+	if s, ok := store.(CacheStoreContext); ok {
+		return s.PutContext(ctx, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Put(key, value)
+}
 
-	dec := gob.NewDecoder(strings.NewReader(s))
-	err := dec.Decode(&pks)
+func storeDel(ctx context.Context, store CacheStore, key string) error {
+	if s, ok := store.(CacheStoreContext); ok {
+		return s.DelContext(ctx, key)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return store.Del(key)
+}
 
+func encodeIds(codec Codec, ids []PK) (string, error) {
+	data, err := codec.Marshal(ids)
+	return string(data), err
+}
+
+func decodeIds(codec Codec, s string) ([]PK, error) {
+	pks := make([]PK, 0)
+	err := codec.Unmarshal([]byte(s), &pks)
 	return pks, err
 }
 
+// GetCacheSql returns the cached ids of sql or ErrCacheMiss
 func GetCacheSql(m Cacher, tableName, sql string, args interface{}) ([]PK, error) {
-	bytes := m.GetIds(tableName, GenSqlKey(sql, args))
+	return GetCacheSqlContext(context.Background(), m, tableName, sql, args)
+}
+
+// GetCacheSqlContext returns the cached ids of sql or ErrCacheMiss. When m is
+// a CacherContext, its errors are returned too.
+func GetCacheSqlContext(ctx context.Context, m Cacher, tableName, sql string, args interface{}) ([]PK, error) {
+	key, err := genSqlKey(cacherDBType(m), sql, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var bytes interface{}
+	if mc, ok := m.(CacherContext); ok {
+		bytes, err = mc.GetIdsContext(ctx, tableName, key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		bytes = m.GetIds(tableName, key)
+	}
 	if bytes == nil {
-		return nil, errors.New("Not Exist")
+		return nil, ErrCacheMiss
 	}
-	return decodeIds(bytes.(string))
+	return decodeIds(cacherCodec(m), bytes.(string))
 }
 
+// PutCacheSql caches the ids of sql. When m is a DepsCacher, the ids also
+// depend on all the tables found in sql by SqlTables.
 func PutCacheSql(m Cacher, ids []PK, tableName, sql string, args interface{}) error {
-	bytes, err := encodeIds(ids)
-	if err != nil {
-		return err
-	}
-	m.PutIds(tableName, GenSqlKey(sql, args), bytes)
-	return nil
+	return PutCacheSqlContext(context.Background(), m, ids, tableName, sql, args)
 }
 
-func GenSqlKey(sql string, args interface{}) string {
-	return fmt.Sprintf("%v-%v", sql, args)
+// PutCacheSqlContext is the context aware variant of PutCacheSql
+func PutCacheSqlContext(ctx context.Context, m Cacher, ids []PK, tableName, sql string, args interface{}) error {
+	var deps []string
+	if _, ok := m.(DepsCacher); ok {
+		deps = SqlTables(sql)
+	}
+	return PutCacheSqlWithDepsContext(ctx, m, ids, tableName, sql, args, deps)
 }
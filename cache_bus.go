@@ -0,0 +1,402 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// InvalidationOp is the cache operation an Invalidation replays
+type InvalidationOp int
+
+const (
+	// InvalidateIds replays DelIds(Table, Key)
+	InvalidateIds InvalidationOp = iota + 1
+	// InvalidateBean replays DelBean(Table, Key)
+	InvalidateBean
+	// InvalidateTableIds replays ClearIds(Table)
+	InvalidateTableIds
+	// InvalidateTableBeans replays ClearBeans(Table)
+	InvalidateTableBeans
+	// InvalidateAll asks to drop every entry, it is sent to the local
+	// subscribers when invalidations may have been lost
+	InvalidateAll
+)
+
+// Invalidation is a cache invalidation sent over an InvalidationBus
+type Invalidation struct {
+	Op     InvalidationOp `json:"op"`
+	Table  string         `json:"table,omitempty"`
+	Key    string         `json:"key,omitempty"`
+	Origin string         `json:"origin,omitempty"`
+}
+
+// InvalidationBus broadcasts invalidations to all the Cachers sharing the
+// same logical cache, including the ones in other processes
+type InvalidationBus interface {
+	Publish(inv Invalidation) error
+	// Subscribe registers fn to receive all the published invalidations,
+	// including the subscriber's own ones, and returns a function to cancel it
+	Subscribe(fn func(Invalidation)) (cancel func())
+	Close() error
+}
+
+var busOriginSeq int64
+
+// newBusOrigin returns an Invalidation origin unique among all the processes
+func newBusOrigin() string {
+	host, _ := os.Hostname()
+	seq := atomic.AddInt64(&busOriginSeq, 1)
+	return fmt.Sprintf("%s-%d-%d-%d", host, os.Getpid(), time.Now().UnixNano(), seq)
+}
+
+// ErrBusClosed is returned when publishing to a closed bus
+var ErrBusClosed = errors.New("xorm/cache: invalidation bus closed")
+
+// LocalBus is an in-process InvalidationBus which calls the subscribers
+// synchronously
+type LocalBus struct {
+	mutex  sync.RWMutex
+	subs   map[int]func(Invalidation)
+	nextID int
+	closed bool
+}
+
+// NewLocalBus creates a LocalBus
+func NewLocalBus() *LocalBus {
+	return &LocalBus{subs: make(map[int]func(Invalidation))}
+}
+
+// Publish implements InvalidationBus
+func (b *LocalBus) Publish(inv Invalidation) error {
+	b.mutex.RLock()
+	if b.closed {
+		b.mutex.RUnlock()
+		return ErrBusClosed
+	}
+	subs := make([]func(Invalidation), 0, len(b.subs))
+	for _, fn := range b.subs {
+		subs = append(subs, fn)
+	}
+	b.mutex.RUnlock()
+
+	for _, fn := range subs {
+		fn(inv)
+	}
+	return nil
+}
+
+// Subscribe implements InvalidationBus
+func (b *LocalBus) Subscribe(fn func(Invalidation)) func() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = fn
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Close implements InvalidationBus
+func (b *LocalBus) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	b.subs = make(map[int]func(Invalidation))
+	return nil
+}
+
+const (
+	// default interval between two attempts to reconnect a SocketBus
+	BusRetryInterval = time.Second
+	// default timeout of writing an invalidation to a peer
+	BusWriteTimeout = time.Second
+)
+
+// SocketBus is an InvalidationBus between the processes of one host which
+// needs no external service. The first process listening on the unix socket
+// or TCP address relays the invalidations to all the others connected to it.
+// When it goes away another process takes its place. Since invalidations
+// could be lost meanwhile, a reconnected process sends InvalidateAll to its
+// local subscribers.
+type SocketBus struct {
+	network string
+	address string
+	local   *LocalBus
+
+	mutex    sync.Mutex
+	listener net.Listener
+	socket   os.FileInfo
+	peers    map[net.Conn]*json.Encoder
+	closed   bool
+	done     chan struct{}
+}
+
+// NewSocketBus creates a SocketBus on a "unix" or "tcp" address
+func NewSocketBus(network, address string) (*SocketBus, error) {
+	b := &SocketBus{
+		network: network,
+		address: address,
+		local:   NewLocalBus(),
+		peers:   make(map[net.Conn]*json.Encoder),
+		done:    make(chan struct{}),
+	}
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// IsHub reports whether this process relays the invalidations of the others
+func (b *SocketBus) IsHub() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.listener != nil
+}
+
+// connect listens on the address, or connects to the process listening on it
+func (b *SocketBus) connect() error {
+	if b.network == "unix" {
+		return b.connectUnix()
+	}
+
+	l, err := net.Listen(b.network, b.address)
+	if err == nil {
+		b.listen(l, nil)
+		return nil
+	}
+	conn, dialErr := net.Dial(b.network, b.address)
+	if dialErr != nil {
+		return err
+	}
+	b.addPeer(conn)
+	go b.read(conn, false)
+	return nil
+}
+
+// connectUnix connects to the process listening on the socket file, or takes
+// its place, replacing the file left by a crashed process. The socket is
+// created aside and renamed to the address, so when several processes do it
+// at once the last one wins and the others find their file replaced.
+func (b *SocketBus) connectUnix() error {
+	if conn, err := net.Dial(b.network, b.address); err == nil {
+		b.addPeer(conn)
+		go b.read(conn, false)
+		return nil
+	}
+	if fi, err := os.Stat(b.address); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("xorm/cache: %s is not a socket", b.address)
+	}
+
+	tmp := fmt.Sprintf("%s.%d.%d", b.address, os.Getpid(), atomic.AddInt64(&busOriginSeq, 1))
+	l, err := net.Listen(b.network, tmp)
+	if err != nil {
+		return err
+	}
+	// the file is removed by Close only while it is ours
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	fi, err := os.Stat(tmp)
+	if err == nil {
+		err = os.Rename(tmp, b.address)
+	}
+	if err != nil {
+		l.Close()
+		os.Remove(tmp)
+		return err
+	}
+	b.listen(l, fi)
+	return nil
+}
+
+// listen makes the bus relay the invalidations of the processes connecting to
+// l, socket is the file of a unix listener
+func (b *SocketBus) listen(l net.Listener, socket os.FileInfo) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		l.Close()
+		b.removeSocket(socket)
+		return
+	}
+	b.listener = l
+	b.socket = socket
+	go b.accept(l)
+	if socket != nil {
+		go b.watch(l, socket)
+	}
+}
+
+// removeSocket removes the socket file unless another process replaced it
+func (b *SocketBus) removeSocket(socket os.FileInfo) {
+	if socket == nil {
+		return
+	}
+	if fi, err := os.Stat(b.address); err == nil && os.SameFile(fi, socket) {
+		os.Remove(b.address)
+	}
+}
+
+// watch gives up relaying when the socket file of l is replaced by another
+// process, so that all the processes connect to the new hub
+func (b *SocketBus) watch(l net.Listener, socket os.FileInfo) {
+	ticker := time.NewTicker(BusRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		if fi, err := os.Stat(b.address); err == nil && os.SameFile(fi, socket) {
+			continue
+		}
+
+		b.mutex.Lock()
+		if b.listener != l {
+			b.mutex.Unlock()
+			return
+		}
+		b.listener = nil
+		b.socket = nil
+		l.Close()
+		for conn := range b.peers {
+			conn.Close()
+		}
+		b.mutex.Unlock()
+		b.reconnect()
+		return
+	}
+}
+
+func (b *SocketBus) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		b.addPeer(conn)
+		go b.read(conn, true)
+	}
+}
+
+func (b *SocketBus) addPeer(conn net.Conn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		conn.Close()
+		return
+	}
+	b.peers[conn] = json.NewEncoder(conn)
+}
+
+func (b *SocketBus) removePeer(conn net.Conn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.peers, conn)
+	conn.Close()
+}
+
+// read delivers the invalidations received from conn, the hub relays them to
+// the other peers
+func (b *SocketBus) read(conn net.Conn, hub bool) {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var inv Invalidation
+		if err := dec.Decode(&inv); err != nil {
+			break
+		}
+		if hub {
+			b.send(inv, conn)
+		}
+		b.local.Publish(inv)
+	}
+	b.removePeer(conn)
+	if !hub {
+		b.reconnect()
+	}
+}
+
+// reconnect is called by a process which lost its hub
+func (b *SocketBus) reconnect() {
+	for {
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		if err := b.connect(); err == nil {
+			b.local.Publish(Invalidation{Op: InvalidateAll})
+			return
+		}
+		select {
+		case <-b.done:
+			return
+		case <-time.After(BusRetryInterval):
+		}
+	}
+}
+
+// send writes inv to all the peers but except
+func (b *SocketBus) send(inv Invalidation, except net.Conn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for conn, enc := range b.peers {
+		if conn == except {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(BusWriteTimeout))
+		if err := enc.Encode(inv); err != nil {
+			// the reader of conn removes it
+			conn.Close()
+		}
+	}
+}
+
+// Publish implements InvalidationBus
+func (b *SocketBus) Publish(inv Invalidation) error {
+	b.mutex.Lock()
+	closed := b.closed
+	b.mutex.Unlock()
+	if closed {
+		return ErrBusClosed
+	}
+	b.send(inv, nil)
+	return b.local.Publish(inv)
+}
+
+// Subscribe implements InvalidationBus
+func (b *SocketBus) Subscribe(fn func(Invalidation)) func() {
+	return b.local.Subscribe(fn)
+}
+
+// Close implements InvalidationBus
+func (b *SocketBus) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	if b.listener != nil {
+		b.listener.Close()
+		b.removeSocket(b.socket)
+	}
+	for conn := range b.peers {
+		conn.Close()
+	}
+	return b.local.Close()
+}
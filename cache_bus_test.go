@@ -0,0 +1,214 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBusCacher(bus InvalidationBus) (*LRUCacher, func()) {
+	store := NewLRUStore(0)
+	cacher := NewLRUCacher(store, 0)
+	cacher.SetBus(bus)
+	return cacher, func() {
+		cacher.SetBus(nil)
+		store.Close()
+	}
+}
+
+func waitForBean(t *testing.T, cacher Cacher, tableName, id string, cached bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if (cacher.GetBean(tableName, id) != nil) == cached {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("bean %s of %s should be cached: %v", id, tableName, cached)
+}
+
+// peerCount returns the number of the processes connected to the bus
+func peerCount(bus *SocketBus) int {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	return len(bus.peers)
+}
+
+func TestLocalBus(t *testing.T) {
+	bus := NewLocalBus()
+	defer bus.Close()
+	a, closeA := newBusCacher(bus)
+	defer closeA()
+	b, closeB := newBusCacher(bus)
+	defer closeB()
+
+	a.PutBean("user", "1", 1)
+	a.PutBean("user", "2", 2)
+	b.PutBean("user", "1", 1)
+	b.PutBean("user", "2", 2)
+	b.PutIds("user", "sql", "ids")
+
+	a.DelBean("user", "1")
+	if b.GetBean("user", "1") != nil || b.GetBean("user", "2") == nil {
+		t.Fatal("DelBean should be applied to the other cacher")
+	}
+
+	a.ClearBeans("user")
+	a.ClearIds("user")
+	if b.GetBean("user", "2") != nil || b.GetIds("user", "sql") != nil {
+		t.Fatal("ClearBeans and ClearIds should be applied to the other cacher")
+	}
+}
+
+func TestSocketBus(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	testSocketBus(t, "tcp", addr)
+}
+
+func TestUnixSocketBus(t *testing.T) {
+	dir, err := os.MkdirTemp("", "xorm-bus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testSocketBus(t, "unix", filepath.Join(dir, "bus.sock"))
+}
+
+func TestUnixSocketBusReplaced(t *testing.T) {
+	dir, err := os.MkdirTemp("", "xorm-bus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "bus.sock")
+
+	// the socket file left by a crashed process
+	l, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	// several processes replace it at once
+	buses := make([]*SocketBus, 4)
+	var wg sync.WaitGroup
+	for i := range buses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bus, err := NewSocketBus("unix", address)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			buses[i] = bus
+		}(i)
+	}
+	wg.Wait()
+	for _, bus := range buses {
+		if bus == nil {
+			t.FailNow()
+		}
+		defer bus.Close()
+	}
+
+	// the ones whose socket was replaced connect to the last one
+	deadline := time.Now().Add(3 * BusRetryInterval)
+	for time.Now().Before(deadline) {
+		var hubs []*SocketBus
+		for _, bus := range buses {
+			if bus.IsHub() {
+				hubs = append(hubs, bus)
+			}
+		}
+		if len(hubs) == 1 && peerCount(hubs[0]) == len(buses)-1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("the buses should have one hub connected to all the others")
+}
+
+func testSocketBus(t *testing.T, network, address string) {
+	hub, err := NewSocketBus(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hub.Close()
+	if !hub.IsHub() {
+		t.Fatal("the first bus should be the hub")
+	}
+
+	var buses []*SocketBus
+	var cachers []*LRUCacher
+	for i := 0; i < 2; i++ {
+		bus, err := NewSocketBus(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bus.Close()
+		if bus.IsHub() {
+			t.Fatal("the other buses should connect to the hub")
+		}
+		cacher, closeCacher := newBusCacher(bus)
+		defer closeCacher()
+		buses = append(buses, bus)
+		cachers = append(cachers, cacher)
+	}
+	hubCacher, closeHubCacher := newBusCacher(hub)
+	defer closeHubCacher()
+	deadline := time.Now().Add(2 * time.Second)
+	for peerCount(hub) != len(buses) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	for _, cacher := range append(cachers, hubCacher) {
+		cacher.PutBean("user", "1", 1)
+		cacher.PutBean("user", "2", 2)
+	}
+
+	// from a peer through the hub to the other peer
+	cachers[0].DelBean("user", "1")
+	waitForBean(t, hubCacher, "user", "1", false)
+	waitForBean(t, cachers[1], "user", "1", false)
+	waitForBean(t, cachers[1], "user", "2", true)
+
+	// one of the peers takes the place of the closed hub
+	hub.Close()
+	deadline = time.Now().Add(3 * BusRetryInterval)
+	for !buses[0].IsHub() && !buses[1].IsHub() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !buses[0].IsHub() && !buses[1].IsHub() {
+		t.Fatal("a peer should become the hub")
+	}
+	// entries are dropped since invalidations could have been lost
+	cachers[0].PutBean("user", "3", 3)
+	cachers[1].PutBean("user", "3", 3)
+	time.Sleep(50 * time.Millisecond)
+
+	deadline = time.Now().Add(3 * BusRetryInterval)
+	for time.Now().Before(deadline) {
+		cachers[0].ClearBeans("user")
+		if cachers[1].GetBean("user", "3") == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("invalidations should be relayed by the new hub")
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"strings"
+)
+
+// DepsCacher is implemented by Cachers which can invalidate a cached SQL id
+// list when any of the tables it depends on, besides its own, is cleared
+type DepsCacher interface {
+	Cacher
+	// AddIdsDeps records that the ids cached by PutIds(tableName, sql, ...)
+	// should also be removed by ClearIds of any of deps
+	AddIdsDeps(tableName, sql string, deps ...string)
+}
+
+// PutCacheSqlWithDeps is like PutCacheSql but the cached ids also depend on
+// the deps tables when m is a DepsCacher
+func PutCacheSqlWithDeps(m Cacher, ids []PK, tableName, sql string, args interface{}, deps []string) error {
+	return PutCacheSqlWithDepsContext(context.Background(), m, ids, tableName, sql, args, deps)
+}
+
+// PutCacheSqlWithDepsContext is the context aware variant of PutCacheSqlWithDeps
+func PutCacheSqlWithDepsContext(ctx context.Context, m Cacher, ids []PK, tableName, sql string, args interface{}, deps []string) error {
+	key, err := genSqlKey(cacherDBType(m), sql, args)
+	if err != nil {
+		return err
+	}
+	bytes, err := encodeIds(cacherCodec(m), ids)
+	if err != nil {
+		return err
+	}
+	if mc, ok := m.(CacherContext); ok {
+		if err = mc.PutIdsContext(ctx, tableName, key, bytes); err != nil {
+			return err
+		}
+	} else {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		m.PutIds(tableName, key, bytes)
+	}
+	if dc, ok := m.(DepsCacher); ok && len(deps) > 0 {
+		dc.AddIdsDeps(tableName, key, deps...)
+	}
+	return nil
+}
+
+// SqlTables returns the names of the tables sql reads or writes, i.e. the
+// ones following FROM, JOIN, UPDATE and INTO, without quotes and schema
+func SqlTables(sql string) []string {
+	tokens := sqlWords(sql)
+	var tables []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = name[i+1:]
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			tables = append(tables, name)
+		}
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		switch strings.ToUpper(tokens[i].text) {
+		case "FROM", "JOIN", "UPDATE", "INTO":
+			if tokens[i].quoted {
+				continue
+			}
+		default:
+			continue
+		}
+
+		// a comma separated list of tables with optional aliases
+		for i+1 < len(tokens) && tokens[i+1].isName() {
+			i++
+			add(tokens[i].text)
+			if i+1 < len(tokens) && strings.EqualFold(tokens[i+1].text, "AS") {
+				i++
+			}
+			if i+1 < len(tokens) && tokens[i+1].isName() && !isSqlKeyword(tokens[i+1].text) {
+				i++
+			}
+			if i+1 >= len(tokens) || tokens[i+1].text != "," {
+				break
+			}
+			i++
+		}
+	}
+	return tables
+}
+
+type sqlWord struct {
+	text   string
+	quoted bool
+}
+
+func (w sqlWord) isName() bool {
+	if w.quoted {
+		return true
+	}
+	if w.text == "" || isSqlKeyword(w.text) {
+		return false
+	}
+	c := w.text[0]
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "JOIN": true, "INNER": true,
+	"LEFT": true, "RIGHT": true, "FULL": true, "OUTER": true, "CROSS": true,
+	"ON": true, "USING": true, "GROUP": true, "ORDER": true, "BY": true,
+	"HAVING": true, "LIMIT": true, "OFFSET": true, "UNION": true, "SET": true,
+	"VALUES": true, "AS": true, "AND": true, "OR": true, "NOT": true,
+	"UPDATE": true, "INTO": true, "INSERT": true, "DELETE": true, "NATURAL": true,
+	"FOR": true, "WITH": true,
+}
+
+func isSqlKeyword(s string) bool {
+	return sqlKeywords[strings.ToUpper(s)]
+}
+
+// sqlWords splits sql into names, with their quotes removed, and single
+// punctuation characters. String literals are skipped.
+func sqlWords(sql string) []sqlWord {
+	var words []sqlWord
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'':
+			i++
+			for i < len(sql) && sql[i] != '\'' {
+				i++
+			}
+			i++
+		case c == '`' || c == '"' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := strings.IndexByte(sql[i+1:], end)
+			if j < 0 {
+				j = len(sql) - i - 1
+			}
+			name := sql[i+1 : i+1+j]
+			i += j + 2
+			// join the parts of a qualified name such as `schema`.`table`
+			if n := len(words); n > 0 && strings.HasSuffix(words[n-1].text, ".") {
+				words[n-1] = sqlWord{words[n-1].text + name, true}
+				continue
+			}
+			words = append(words, sqlWord{name, true})
+		case c == '_' || c == '.' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+			j := i
+			for j < len(sql) {
+				if c = sql[j]; c == '_' || c == '.' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80 {
+					j++
+					continue
+				}
+				break
+			}
+			if n := len(words); n > 0 && sql[i] == '.' {
+				words[n-1].text += sql[i:j]
+			} else {
+				words = append(words, sqlWord{sql[i:j], false})
+			}
+			i = j
+		default:
+			words = append(words, sqlWord{string(c), false})
+			i++
+		}
+	}
+	return words
+}
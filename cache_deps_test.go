@@ -0,0 +1,65 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSqlTables(t *testing.T) {
+	var kases = []struct {
+		sql    string
+		tables []string
+	}{
+		{"select * from user where id = ?", []string{"user"}},
+		{"SELECT u.id FROM `user` AS u INNER JOIN `order` o ON o.uid = u.id", []string{"user", "order"}},
+		{"select * from user u, \"db\".\"order\" o where u.name = 'from x'", []string{"user", "order"}},
+		{"select * from (select id from user) t left join orders on t.id = orders.uid", []string{"user", "orders"}},
+		{"insert into user (name) values (?)", []string{"user"}},
+		{"update `user` set `from` = ?", []string{"user"}},
+	}
+
+	for _, kase := range kases {
+		tables := SqlTables(kase.sql)
+		if !reflect.DeepEqual(tables, kase.tables) {
+			t.Errorf("tables of %q should be %v, got %v", kase.sql, kase.tables, tables)
+		}
+	}
+}
+
+func TestLRUCacherDeps(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+
+	join := "select user.id from user join `order` on order.uid = user.id where order.amount > ?"
+	if err := PutCacheSql(cacher, []PK{{int64(1)}}, "user", join, []interface{}{10}); err != nil {
+		t.Fatal(err)
+	}
+	other := "select id from user explicit"
+	if err := PutCacheSqlWithDeps(cacher, []PK{{int64(2)}}, "user", other, nil, []string{"payment"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cacher.ClearIds("order")
+	if _, err := GetCacheSql(cacher, "user", join, []interface{}{10}); err == nil {
+		t.Fatal("ids of the join should be cleared with order")
+	}
+	if _, err := GetCacheSql(cacher, "user", other, nil); err != nil {
+		t.Fatal("ids not depending on order should be kept")
+	}
+
+	cacher.ClearIds("payment")
+	if _, err := GetCacheSql(cacher, "user", other, nil); err == nil {
+		t.Fatal("ids of explicit deps should be cleared with payment")
+	}
+	if store.Len() != 0 {
+		t.Fatal("store should be empty, got", store.Len())
+	}
+	if s := cacher.CacheStats()["user"]; s.Size != 0 {
+		t.Fatal("size of user should be 0, got", s.Size)
+	}
+}
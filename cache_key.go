@@ -0,0 +1,233 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var valuerType = reflect.TypeOf((*driver.Valuer)(nil)).Elem()
+
+// DBTypeCacher is implemented by Cachers which know the type of the database
+// whose SQL they cache the ids of, its keys being normalized with its syntax
+type DBTypeCacher interface {
+	DBType() DbType
+}
+
+func cacherDBType(m Cacher) DbType {
+	if dc, ok := m.(DBTypeCacher); ok {
+		return dc.DBType()
+	}
+	return ""
+}
+
+// GenSqlKey generates a fixed length cache key of sql and its args. Whitespaces
+// out of quoted strings and comments are normalized and every argument is
+// encoded with its type, so equivalent queries share a key and different ones
+// never do. When an argument's driver.Valuer fails, the key is built from its
+// type and error. The SQL is not normalized when it has syntax whose meaning
+// depends on the database, see GenSqlKeyOf.
+func GenSqlKey(sql string, args interface{}) string {
+	return GenSqlKeyOf("", sql, args)
+}
+
+// GenSqlKeyOf is like GenSqlKey but sql is normalized with the syntax of the
+// databases of type dbType, such as the backslash escapes of MySQL
+func GenSqlKeyOf(dbType DbType, sql string, args interface{}) string {
+	key, err := genSqlKey(dbType, sql, args)
+	if err != nil {
+		h := sha256.New()
+		h.Write([]byte(normalizeSql(dbType, sql)))
+		fmt.Fprintf(h, "\x00e%T:%v", args, err)
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	return key
+}
+
+func genSqlKey(dbType DbType, sql string, args interface{}) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(normalizeSql(dbType, sql)))
+	h.Write([]byte{0})
+	if err := writeKeyArg(h, reflect.ValueOf(args), 0); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// normalizeSql trims the code of sql and collapses its whitespace runs into
+// one space, the strings, identifiers and comments being kept as they are. A
+// line comment keeps its end of line, which would otherwise comment out the
+// code after it. When dbType is unknown, sql is kept as it is if it has
+// backslashes, # or [ or $, whose meaning depends on the database.
+func normalizeSql(dbType DbType, sql string) string {
+	l := sqlLexer{}
+	if dbType != "" {
+		l = lexerOfType(dbType)
+	} else if strings.ContainsAny(sql, "\\#[$") {
+		return sql
+	}
+
+	res := make([]byte, 0, len(sql))
+	var space, line bool
+	sep := func() {
+		if line {
+			res = append(res, '\n')
+		} else if space && len(res) > 0 {
+			res = append(res, ' ')
+		}
+		space, line = false, false
+	}
+	for _, seg := range l.split(sql) {
+		if seg.kind != sqlCode {
+			sep()
+			res = append(res, seg.text...)
+			line = seg.kind == sqlComment && !strings.HasPrefix(seg.text, "/*")
+			continue
+		}
+		for i := 0; i < len(seg.text); i++ {
+			c := seg.text[i]
+			switch c {
+			case ' ', '\t', '\n', '\r', '\f', '\v':
+				space = true
+				continue
+			}
+			sep()
+			res = append(res, c)
+		}
+	}
+	return string(res)
+}
+
+func writeKeyString(h hash.Hash, tag byte, s string) {
+	h.Write([]byte{tag})
+	h.Write([]byte(strconv.Itoa(len(s))))
+	h.Write([]byte{':'})
+	h.Write([]byte(s))
+}
+
+// maxKeyArgDepth is the deepest nesting of the values encoded in the keys,
+// which stops the cycles of pointers
+const maxKeyArgDepth = 32
+
+var errKeyArgDepth = errors.New("xorm/cache: argument nested too deeply")
+
+// writeKeyArg writes a type tagged and length prefixed encoding of v to h,
+// the structs and the maps being encoded by value, their map entries sorted
+func writeKeyArg(h hash.Hash, v reflect.Value, depth int) error {
+	if !v.IsValid() {
+		h.Write([]byte{'n'})
+		return nil
+	}
+	if depth > maxKeyArgDepth {
+		return errKeyArgDepth
+	}
+	depth++
+
+	if v.Type().Implements(valuerType) && v.CanInterface() {
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+			h.Write([]byte{'n'})
+			return nil
+		}
+		value, err := v.Interface().(driver.Valuer).Value()
+		if err != nil {
+			return err
+		}
+		return writeKeyArg(h, reflect.ValueOf(value), depth)
+	}
+
+	if v.Type() == TimeType && v.CanInterface() {
+		writeKeyString(h, 't', v.Interface().(time.Time).UTC().Format(time.RFC3339Nano))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			h.Write([]byte{'n'})
+			return nil
+		}
+		return writeKeyArg(h, v.Elem(), depth)
+	case reflect.Bool:
+		writeKeyString(h, 'B', strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeKeyString(h, 'i', strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeKeyString(h, 'u', strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		writeKeyString(h, 'f', strconv.FormatFloat(v.Float(), 'g', -1, 64))
+	case reflect.String:
+		writeKeyString(h, 's', v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				h.Write([]byte{'n'})
+				return nil
+			}
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			writeKeyString(h, 'b', string(b))
+			return nil
+		}
+		writeKeyString(h, 'a', strconv.Itoa(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := writeKeyArg(h, v.Index(i), depth); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		writeKeyString(h, 'S', v.Type().String())
+		h.Write([]byte(strconv.Itoa(v.NumField())))
+		for i := 0; i < v.NumField(); i++ {
+			writeKeyString(h, 'F', v.Type().Field(i).Name)
+			if err := writeKeyArg(h, v.Field(i), depth); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			h.Write([]byte{'n'})
+			return nil
+		}
+		// the entries are sorted by the encodings of their keys
+		type entry struct {
+			key   string
+			value reflect.Value
+		}
+		entries := make([]entry, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			kh := sha256.New()
+			if err := writeKeyArg(kh, iter.Key(), depth); err != nil {
+				return err
+			}
+			entries = append(entries, entry{string(kh.Sum(nil)), iter.Value()})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		writeKeyString(h, 'm', strconv.Itoa(len(entries)))
+		for _, e := range entries {
+			h.Write([]byte(e.key))
+			if err := writeKeyArg(h, e.value, depth); err != nil {
+				return err
+			}
+		}
+	default:
+		if !v.CanInterface() {
+			writeKeyString(h, 'x', v.Type().String())
+			return nil
+		}
+		writeKeyString(h, 'x', fmt.Sprintf("%T:%#v", v.Interface(), v.Interface()))
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+type failedValuer struct{}
+
+func (failedValuer) Value() (driver.Value, error) {
+	return nil, errors.New("failed")
+}
+
+type keyStruct struct {
+	P    *int64
+	Tags map[string]interface{}
+	n    int
+}
+
+type keyNode struct {
+	Next *keyNode
+}
+
+func TestGenSqlKey(t *testing.T) {
+	sql := "select * from user where name = ?"
+	a, b := int64(1), int64(1)
+	c := int64(2)
+	loc := time.FixedZone("UTC+8", 8*3600)
+	now := time.Now()
+
+	var sameKeys = []struct {
+		sql1, sql2   string
+		args1, args2 interface{}
+	}{
+		{"select  *\n\tfrom user", "select * from user", nil, nil},
+		{sql, sql, []interface{}{&a}, []interface{}{&b}},
+		{sql, sql, []interface{}{now}, []interface{}{now.In(loc)}},
+		{sql, sql, []interface{}{NullTime(now)}, []interface{}{now.Format("2006-01-02 15:04:05")}},
+		{sql, sql, []interface{}{keyStruct{P: &a}}, []interface{}{keyStruct{P: &b}}},
+		{sql, sql, []interface{}{map[string]interface{}{"a": 1, "b": &a, "c": "c", "d": nil}},
+			[]interface{}{map[string]interface{}{"d": nil, "c": "c", "b": &b, "a": 1}}},
+		{sql, sql, []interface{}{keyStruct{Tags: map[string]interface{}{"a": &a}}},
+			[]interface{}{keyStruct{Tags: map[string]interface{}{"a": &b}}}},
+	}
+	for _, k := range sameKeys {
+		if GenSqlKey(k.sql1, k.args1) != GenSqlKey(k.sql2, k.args2) {
+			t.Errorf("%q %v and %q %v should have the same key", k.sql1, k.args1, k.sql2, k.args2)
+		}
+	}
+
+	var diffKeys = []struct {
+		sql1, sql2   string
+		args1, args2 interface{}
+	}{
+		{"select * from user where name = 'a  b'", "select * from user where name = 'a b'", nil, nil},
+		{sql, sql, []interface{}{"1"}, []interface{}{[]byte("1")}},
+		{sql, sql, []interface{}{"1"}, []interface{}{1}},
+		{sql, sql, []interface{}{"a b"}, []interface{}{"a", "b"}},
+		{sql, sql, []interface{}{[]interface{}{"a"}, "b"}, []interface{}{"a", []interface{}{"b"}}},
+		{sql, sql, []interface{}{keyStruct{P: &a}}, []interface{}{keyStruct{P: &c}}},
+		{sql, sql, []interface{}{keyStruct{P: &a, n: 1}}, []interface{}{keyStruct{P: &a, n: 2}}},
+		{sql, sql, []interface{}{map[string]int{"a": 1}}, []interface{}{map[string]int{"a": 2}}},
+		{sql, sql, []interface{}{map[string]int{"a": 1}}, []interface{}{map[string]int{"b": 1}}},
+		{sql, sql, []interface{}{map[string]int{}}, []interface{}{map[string]int(nil)}},
+	}
+	for _, k := range diffKeys {
+		if GenSqlKey(k.sql1, k.args1) == GenSqlKey(k.sql2, k.args2) {
+			t.Errorf("%q %v and %q %v should have different keys", k.sql1, k.args1, k.sql2, k.args2)
+		}
+	}
+
+	var dbKeys = []struct {
+		dbType     DbType
+		sql1, sql2 string
+		same       bool
+	}{
+		{"", `select * from user where name = 'it\'s  a'`, `select * from user where name = 'it\'s a'`, false},
+		{MYSQL, `select * from user where name = 'it\'s  a'`, `select * from user where name = 'it\'s a'`, false},
+		{MYSQL, "select  * from user # a  b", "select * from user # a  b", true},
+		{MYSQL, "select * from user # a  b", "select * from user # a b", false},
+		{SQLITE, "select 1 -- c\n, 2", "select 1 -- c , 2", false},
+		{SQLITE, "select 1 -- c\n  , 2", "select 1 -- c\n, 2", true},
+		{SQLITE, "select 1 /* a  b */ ,  2", "select 1 /* a  b */ , 2", true},
+		{SQLITE, "select 1 /* a  b */", "select 1 /* a b */", false},
+		{POSTGRES, "select $$a  b$$", "select $$a b$$", false},
+		{"", "select 1 -- c\n, 2", "select 1 -- c , 2", false},
+	}
+	for _, k := range dbKeys {
+		if (GenSqlKeyOf(k.dbType, k.sql1, nil) == GenSqlKeyOf(k.dbType, k.sql2, nil)) != k.same {
+			t.Errorf("%s: %q and %q should have the same key: %v", k.dbType, k.sql1, k.sql2, k.same)
+		}
+	}
+
+	if len(GenSqlKey(sql+sql+sql, []interface{}{1, 2, 3})) != 64 {
+		t.Error("key should have a fixed length")
+	}
+
+	node := &keyNode{}
+	node.Next = node
+	if _, err := genSqlKey("", sql, []interface{}{node}); err == nil {
+		t.Error("a cycle of pointers should be an error")
+	}
+	if _, err := genSqlKey("", sql, []interface{}{failedValuer{}}); err == nil {
+		t.Error("valuer error should be returned")
+	}
+}
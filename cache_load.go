@@ -0,0 +1,175 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var errLoadPanicked = errors.New("xorm/cache: load panicked")
+
+type loadCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+	// waiters is the number of the calls waiting for this one
+	waiters int
+}
+
+// loadGroup collapses the concurrent loads of the same key into one call
+type loadGroup struct {
+	mutex sync.Mutex
+	calls map[string]*loadCall
+}
+
+// do calls fn unless a call of key is in flight, in which case it waits for
+// that call and returns its result
+func (g *loadGroup) do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*loadCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		c.waiters++
+		g.mutex.Unlock()
+		select {
+		case <-c.done:
+			return c.val, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &loadCall{done: make(chan struct{}), err: errLoadPanicked}
+	g.calls[key] = c
+	g.mutex.Unlock()
+
+	defer func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
+
+// waiters returns the number of the calls waiting for the call of key in
+// flight
+func (g *loadGroup) waiters(key string) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if c, ok := g.calls[key]; ok {
+		return c.waiters
+	}
+	return 0
+}
+
+var cacheLoads loadGroup
+
+// cacherID distinguishes the loads of different cachers sharing table names
+func cacherID(m Cacher) string {
+	if v := reflect.ValueOf(m); v.Kind() == reflect.Ptr {
+		return fmt.Sprintf("%T:%x", m, v.Pointer())
+	}
+	return fmt.Sprintf("%T", m)
+}
+
+// GetCacheSqlOrLoad returns the cached ids of sql. On a miss, load is called
+// once for all the concurrent callers of the same sql and args, its ids are
+// cached and all of them get its result or error. Errors of the cache itself
+// are returned only by the lookup, a loaded result which cannot be cached is
+// still returned.
+func GetCacheSqlOrLoad(m Cacher, tableName, sql string, args interface{}, load func() ([]PK, error)) ([]PK, error) {
+	return GetCacheSqlOrLoadContext(context.Background(), m, tableName, sql, args, load)
+}
+
+// GetCacheSqlOrLoadContext is the context aware variant of GetCacheSqlOrLoad
+func GetCacheSqlOrLoadContext(ctx context.Context, m Cacher, tableName, sql string, args interface{}, load func() ([]PK, error)) ([]PK, error) {
+	ids, err := GetCacheSqlContext(ctx, m, tableName, sql, args)
+	if err != ErrCacheMiss {
+		return ids, err
+	}
+
+	key, err := genSqlKey(cacherDBType(m), sql, args)
+	if err != nil {
+		return nil, err
+	}
+	v, err := cacheLoads.do(ctx, cacherID(m)+"\x00"+genSqlCacheKey(tableName, key), func() (interface{}, error) {
+		ids, err := load()
+		if err != nil {
+			return nil, err
+		}
+		PutCacheSqlContext(ctx, m, ids, tableName, sql, args)
+		return ids, nil
+	})
+	if v == nil {
+		return nil, err
+	}
+	return v.([]PK), err
+}
+
+// GetCacheBeanOrLoad returns the cached bean of id. On a miss, load is called
+// once for all the concurrent callers of the same id, a non nil bean is cached
+// and all of them get its result or error. When m is a NegativeCacher, a nil
+// bean is remembered too and nil is returned without calling load until it
+// expires.
+func GetCacheBeanOrLoad(m Cacher, tableName, id string, load func() (interface{}, error)) (interface{}, error) {
+	return GetCacheBeanOrLoadContext(context.Background(), m, tableName, id, load)
+}
+
+// GetCacheBeanOrLoadContext is the context aware variant of GetCacheBeanOrLoad
+func GetCacheBeanOrLoadContext(ctx context.Context, m Cacher, tableName, id string, load func() (interface{}, error)) (interface{}, error) {
+	bean, err := getCacheBean(ctx, m, tableName, id)
+	if err != ErrCacheMiss {
+		return bean, err
+	}
+	nc, negative := m.(NegativeCacher)
+	if negative && nc.IsBeanNotFound(tableName, id) {
+		return nil, nil
+	}
+
+	return cacheLoads.do(ctx, cacherID(m)+"\x00"+genBeanCacheKey(tableName, id), func() (interface{}, error) {
+		bean, err := load()
+		if err != nil {
+			return nil, err
+		}
+		if bean == nil {
+			if negative {
+				nc.PutBeanNotFound(tableName, id)
+			}
+			return nil, nil
+		}
+		putCacheBean(ctx, m, tableName, id, bean)
+		return bean, nil
+	})
+}
+
+func getCacheBean(ctx context.Context, m Cacher, tableName, id string) (interface{}, error) {
+	if mc, ok := m.(CacherContext); ok {
+		return mc.GetBeanContext(ctx, tableName, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if bean := m.GetBean(tableName, id); bean != nil {
+		return bean, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+func putCacheBean(ctx context.Context, m Cacher, tableName, id string, bean interface{}) error {
+	if mc, ok := m.(CacherContext); ok {
+		return mc.PutBeanContext(ctx, tableName, id, bean)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.PutBean(tableName, id, bean)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"errors"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// waitLoad waits until n calls wait for the load of key in flight
+func waitLoad(key string, n int) {
+	for cacheLoads.waiters(key) < n {
+		runtime.Gosched()
+	}
+}
+
+func TestGetCacheSqlOrLoad(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+
+	var loads int32
+	release := make(chan struct{})
+	load := func() ([]PK, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []PK{{int64(1)}}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]PK, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids, err := GetCacheSqlOrLoad(cacher, "user", "select id from user", nil, load)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = ids
+		}(i)
+	}
+	key, _ := genSqlKey(cacherDBType(cacher), "select id from user", nil)
+	waitLoad(cacherID(cacher)+"\x00"+genSqlCacheKey("user", key), len(results)-1)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatal("load should be called once, called", loads)
+	}
+	for _, ids := range results {
+		if !reflect.DeepEqual(ids, []PK{{int64(1)}}) {
+			t.Fatal("unexpected ids", ids)
+		}
+	}
+	if _, err := GetCacheSql(cacher, "user", "select id from user", nil); err != nil {
+		t.Fatal("loaded ids should be cached, got", err)
+	}
+}
+
+func TestGetCacheBeanOrLoadError(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+
+	errLoad := errors.New("load failed")
+	var loads int32
+	release := make(chan struct{})
+	load := func() (interface{}, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return nil, errLoad
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := GetCacheBeanOrLoad(cacher, "user", "1", load); err != errLoad {
+				t.Error("the load error should be shared, got", err)
+			}
+		}()
+	}
+	waitLoad(cacherID(cacher)+"\x00"+genBeanCacheKey("user", "1"), 4)
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatal("load should be called once, called", loads)
+	}
+	if cacher.GetBean("user", "1") != nil {
+		t.Fatal("nothing should be cached on error")
+	}
+}
@@ -0,0 +1,507 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type cacheNode struct {
+	tableName string
+	key       string
+	deps      []string
+}
+
+// cacheIndex records the keys cached for every table in least recently used
+// order, and the keys which depend on other tables than their own
+type cacheIndex struct {
+	list   *list.List
+	tables map[string]map[string]*list.Element
+	deps   map[string]map[string]*list.Element
+}
+
+func newCacheIndex() *cacheIndex {
+	return &cacheIndex{
+		list:   list.New(),
+		tables: make(map[string]map[string]*list.Element),
+		deps:   make(map[string]map[string]*list.Element),
+	}
+}
+
+// touch marks key as the most recently used one, adding it when absent. It
+// reports whether key was added.
+func (idx *cacheIndex) touch(tableName, key string) bool {
+	keys, ok := idx.tables[tableName]
+	if !ok {
+		keys = make(map[string]*list.Element)
+		idx.tables[tableName] = keys
+	}
+	if e, ok := keys[key]; ok {
+		idx.list.MoveToFront(e)
+		return false
+	}
+	keys[key] = idx.list.PushFront(&cacheNode{tableName: tableName, key: key})
+	return true
+}
+
+// addDeps makes an indexed key depend on the deps tables too
+func (idx *cacheIndex) addDeps(tableName, key string, deps ...string) {
+	e, ok := idx.tables[tableName][key]
+	if !ok {
+		return
+	}
+	node := e.Value.(*cacheNode)
+	for _, dep := range deps {
+		if dep == tableName {
+			continue
+		}
+		keys, ok := idx.deps[dep]
+		if !ok {
+			keys = make(map[string]*list.Element)
+			idx.deps[dep] = keys
+		}
+		if _, ok := keys[key]; !ok {
+			keys[key] = e
+			node.deps = append(node.deps, dep)
+		}
+	}
+}
+
+// remove forgets key and reports whether it was indexed
+func (idx *cacheIndex) remove(tableName, key string) bool {
+	keys, ok := idx.tables[tableName]
+	if !ok {
+		return false
+	}
+	e, ok := keys[key]
+	if ok {
+		idx.removeElement(e)
+	}
+	return ok
+}
+
+func (idx *cacheIndex) removeElement(e *list.Element) {
+	node := e.Value.(*cacheNode)
+	idx.list.Remove(e)
+	if keys, ok := idx.tables[node.tableName]; ok {
+		delete(keys, node.key)
+		if len(keys) == 0 {
+			delete(idx.tables, node.tableName)
+		}
+	}
+	for _, dep := range node.deps {
+		if keys, ok := idx.deps[dep]; ok {
+			delete(keys, node.key)
+			if len(keys) == 0 {
+				delete(idx.deps, dep)
+			}
+		}
+	}
+}
+
+// removeTable forgets all the keys of the table and the ones depending on it,
+// and returns their nodes
+func (idx *cacheIndex) removeTable(tableName string) []*cacheNode {
+	var elements []*list.Element
+	for _, e := range idx.tables[tableName] {
+		elements = append(elements, e)
+	}
+	for _, e := range idx.deps[tableName] {
+		elements = append(elements, e)
+	}
+
+	res := make([]*cacheNode, 0, len(elements))
+	for _, e := range elements {
+		node := e.Value.(*cacheNode)
+		// a key may be both of the table and depend on it
+		if _, ok := idx.tables[node.tableName][node.key]; !ok {
+			continue
+		}
+		idx.removeElement(e)
+		res = append(res, node)
+	}
+	return res
+}
+
+// oldest returns the least recently used node or nil
+func (idx *cacheIndex) oldest() *cacheNode {
+	if e := idx.list.Back(); e != nil {
+		return e.Value.(*cacheNode)
+	}
+	return nil
+}
+
+func (idx *cacheIndex) len() int {
+	return idx.list.Len()
+}
+
+// LRUCacher implements Cacher on top of any CacheStore. It keeps per table
+// indexes of the cached SQL keys and bean ids so that ClearIds and ClearBeans
+// remove exactly one table's entries, and drops the least recently used
+// entries once MaxElementSize (0 means no limit) is exceeded.
+type LRUCacher struct {
+	MaxElementSize int
+	// NegativeExpired is how long PutBeanNotFound entries are kept,
+	// CacheNegativeExpired when 0
+	NegativeExpired time.Duration
+
+	store CacheStore
+	codec Codec
+	// dbType is the type of the database whose SQL keys are normalized
+	dbType DbType
+	mutex  sync.Mutex
+	ids    *cacheIndex
+	sqls   *cacheIndex
+	stats  cacheStats
+
+	bus         InvalidationBus
+	origin      string
+	unsubscribe func()
+}
+
+// NewLRUCacher creates a LRUCacher which stores its entries in store
+func NewLRUCacher(store CacheStore, maxElementSize int) *LRUCacher {
+	return &LRUCacher{
+		MaxElementSize: maxElementSize,
+		store:          store,
+		ids:            newCacheIndex(),
+		sqls:           newCacheIndex(),
+		origin:         newBusOrigin(),
+	}
+}
+
+// Store returns the CacheStore the cacher writes to
+func (m *LRUCacher) Store() CacheStore {
+	return m.store
+}
+
+// SetCodec sets the Codec the cached id lists are encoded with
+func (m *LRUCacher) SetCodec(codec Codec) {
+	m.codec = codec
+}
+
+// Codec implements CodecCacher, it returns GobCodec unless SetCodec is called
+func (m *LRUCacher) Codec() Codec {
+	if m.codec == nil {
+		return GobCodec
+	}
+	return m.codec
+}
+
+// SetDBType sets the type of the database of the cached SQL, so that its keys
+// are normalized with its syntax
+func (m *LRUCacher) SetDBType(dbType DbType) {
+	m.dbType = dbType
+}
+
+// DBType implements DBTypeCacher
+func (m *LRUCacher) DBType() DbType {
+	return m.dbType
+}
+
+func genSqlCacheKey(tableName, sql string) string {
+	return tableName + "-s-" + sql
+}
+
+func genBeanCacheKey(tableName, id string) string {
+	return tableName + "-p-" + id
+}
+
+// GetIds returns the cached ids of sql or nil
+func (m *LRUCacher) GetIds(tableName, sql string) interface{} {
+	ids, _ := m.GetIdsContext(context.Background(), tableName, sql)
+	return ids
+}
+
+// GetBean returns the cached bean of id or nil
+func (m *LRUCacher) GetBean(tableName string, id string) interface{} {
+	bean, _ := m.GetBeanContext(context.Background(), tableName, id)
+	return bean
+}
+
+// PutIds caches the ids of sql
+func (m *LRUCacher) PutIds(tableName, sql string, ids interface{}) {
+	m.PutIdsContext(context.Background(), tableName, sql, ids)
+}
+
+// PutBean caches the bean of id
+func (m *LRUCacher) PutBean(tableName string, id string, obj interface{}) {
+	m.PutBeanContext(context.Background(), tableName, id, obj)
+}
+
+// DelIds removes the cached ids of sql
+func (m *LRUCacher) DelIds(tableName, sql string) {
+	m.DelIdsContext(context.Background(), tableName, sql)
+}
+
+// DelBean removes the cached bean of id
+func (m *LRUCacher) DelBean(tableName string, id string) {
+	m.DelBeanContext(context.Background(), tableName, id)
+}
+
+// AddIdsDeps implements DepsCacher
+func (m *LRUCacher) AddIdsDeps(tableName, sql string, deps ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sqls.addDeps(tableName, genSqlCacheKey(tableName, sql), deps...)
+}
+
+// ClearIds removes all the cached ids of the table and the ones depending on it
+func (m *LRUCacher) ClearIds(tableName string) {
+	m.ClearIdsContext(context.Background(), tableName)
+}
+
+// ClearBeans removes all the cached beans of the table
+func (m *LRUCacher) ClearBeans(tableName string) {
+	m.ClearBeansContext(context.Background(), tableName)
+}
+
+// GetIdsContext implements CacherContext
+func (m *LRUCacher) GetIdsContext(ctx context.Context, tableName, sql string) (interface{}, error) {
+	return m.get(ctx, m.sqls, tableName, genSqlCacheKey(tableName, sql))
+}
+
+// GetBeanContext implements CacherContext
+func (m *LRUCacher) GetBeanContext(ctx context.Context, tableName, id string) (interface{}, error) {
+	return m.get(ctx, m.ids, tableName, genBeanCacheKey(tableName, id))
+}
+
+// PutIdsContext implements CacherContext
+func (m *LRUCacher) PutIdsContext(ctx context.Context, tableName, sql string, ids interface{}) error {
+	return m.put(ctx, m.sqls, tableName, genSqlCacheKey(tableName, sql), ids)
+}
+
+// PutBeanContext implements CacherContext
+func (m *LRUCacher) PutBeanContext(ctx context.Context, tableName, id string, obj interface{}) error {
+	if err := m.put(ctx, m.ids, tableName, genBeanCacheKey(tableName, id), obj); err != nil {
+		return err
+	}
+	return m.del(ctx, m.ids, tableName, genNegativeCacheKey(tableName, id))
+}
+
+// DelIdsContext implements CacherContext
+func (m *LRUCacher) DelIdsContext(ctx context.Context, tableName, sql string) error {
+	err := m.del(ctx, m.sqls, tableName, genSqlCacheKey(tableName, sql))
+	return m.publish(err, InvalidateIds, tableName, sql)
+}
+
+// DelBeanContext implements CacherContext
+func (m *LRUCacher) DelBeanContext(ctx context.Context, tableName, id string) error {
+	err := m.delBean(ctx, tableName, id)
+	return m.publish(err, InvalidateBean, tableName, id)
+}
+
+// ClearIdsContext implements CacherContext
+func (m *LRUCacher) ClearIdsContext(ctx context.Context, tableName string) error {
+	err := m.clear(ctx, m.sqls, tableName, true)
+	return m.publish(err, InvalidateTableIds, tableName, "")
+}
+
+// ClearBeansContext implements CacherContext
+func (m *LRUCacher) ClearBeansContext(ctx context.Context, tableName string) error {
+	err := m.clear(ctx, m.ids, tableName, true)
+	return m.publish(err, InvalidateTableBeans, tableName, "")
+}
+
+// SetBus makes the cacher publish its deletions to bus and apply the ones
+// published by the other cachers, a nil bus detaches it
+func (m *LRUCacher) SetBus(bus InvalidationBus) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.unsubscribe != nil {
+		m.unsubscribe()
+		m.unsubscribe = nil
+	}
+	m.bus = bus
+	if bus != nil {
+		m.unsubscribe = bus.Subscribe(m.invalidate)
+	}
+}
+
+// publish sends an invalidation to the bus and returns err or the bus error
+func (m *LRUCacher) publish(err error, op InvalidationOp, tableName, key string) error {
+	m.mutex.Lock()
+	bus := m.bus
+	m.mutex.Unlock()
+	if bus == nil {
+		return err
+	}
+	if perr := bus.Publish(Invalidation{op, tableName, key, m.origin}); err == nil {
+		err = perr
+	}
+	return err
+}
+
+// invalidate applies an invalidation published by another cacher
+func (m *LRUCacher) invalidate(inv Invalidation) {
+	if inv.Origin == m.origin {
+		return
+	}
+
+	ctx := context.Background()
+	switch inv.Op {
+	case InvalidateIds:
+		m.del(ctx, m.sqls, inv.Table, genSqlCacheKey(inv.Table, inv.Key))
+	case InvalidateBean:
+		m.delBean(ctx, inv.Table, inv.Key)
+	case InvalidateTableIds:
+		m.clear(ctx, m.sqls, inv.Table, false)
+	case InvalidateTableBeans:
+		m.clear(ctx, m.ids, inv.Table, false)
+	case InvalidateAll:
+		for _, idx := range []*cacheIndex{m.sqls, m.ids} {
+			m.mutex.Lock()
+			tableNames := make([]string, 0, len(idx.tables))
+			for tableName := range idx.tables {
+				tableNames = append(tableNames, tableName)
+			}
+			m.mutex.Unlock()
+			for _, tableName := range tableNames {
+				m.clear(ctx, idx, tableName, false)
+			}
+		}
+	}
+}
+
+// CacheStats implements CacheStatsReporter
+func (m *LRUCacher) CacheStats() map[string]CacheStats {
+	return m.stats.snapshot()
+}
+
+// ResetCacheStats implements CacheStatsReporter
+func (m *LRUCacher) ResetCacheStats() {
+	m.stats.reset()
+}
+
+// The mutex of the cacher only guards its indexes, the store is accessed
+// without it so that a slow store does not block the other lookups.
+
+func (m *LRUCacher) get(ctx context.Context, idx *cacheIndex, tableName, key string) (interface{}, error) {
+	v, err := storeGet(ctx, m.store, key)
+	if err != nil {
+		if err == ErrCacheMiss {
+			m.mutex.Lock()
+			m.unindex(idx, tableName, key)
+			m.mutex.Unlock()
+			m.stats.miss(tableName)
+		}
+		return nil, err
+	}
+	m.mutex.Lock()
+	m.index(idx, tableName, key)
+	m.mutex.Unlock()
+	m.stats.hit(tableName)
+	return v, nil
+}
+
+func (m *LRUCacher) put(ctx context.Context, idx *cacheIndex, tableName, key string, value interface{}) error {
+	return m.insert(ctx, idx, tableName, key, func() error {
+		return storePut(ctx, m.store, key, value)
+	})
+}
+
+// insert indexes key once written to the store by write
+func (m *LRUCacher) insert(ctx context.Context, idx *cacheIndex, tableName, key string, write func() error) error {
+	if err := write(); err != nil {
+		m.mutex.Lock()
+		m.unindex(idx, tableName, key)
+		m.mutex.Unlock()
+		return err
+	}
+	m.stats.put(tableName)
+
+	var evicted []*cacheNode
+	m.mutex.Lock()
+	m.index(idx, tableName, key)
+	for m.MaxElementSize > 0 && idx.len() > m.MaxElementSize {
+		node := idx.oldest()
+		m.unindex(idx, node.tableName, node.key)
+		evicted = append(evicted, node)
+	}
+	m.mutex.Unlock()
+
+	for _, node := range evicted {
+		storeDel(ctx, m.store, node.key)
+		m.stats.evict(node.tableName)
+	}
+	return nil
+}
+
+func (m *LRUCacher) del(ctx context.Context, idx *cacheIndex, tableName, key string) error {
+	m.mutex.Lock()
+	m.unindex(idx, tableName, key)
+	m.mutex.Unlock()
+	if err := storeDel(ctx, m.store, key); err != nil && err != ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// delBean removes the bean of id and the record of its absence
+func (m *LRUCacher) delBean(ctx context.Context, tableName, id string) error {
+	err := m.del(ctx, m.ids, tableName, genBeanCacheKey(tableName, id))
+	if nerr := m.del(ctx, m.ids, tableName, genNegativeCacheKey(tableName, id)); err == nil {
+		err = nerr
+	}
+	return err
+}
+
+// clear drops the entries of the table, shared tells to clear it in the
+// stores shared with the other cachers too. The invalidations published by
+// the other cachers only drop the local state of a tableClearer store.
+func (m *LRUCacher) clear(ctx context.Context, idx *cacheIndex, tableName string, shared bool) error {
+	m.mutex.Lock()
+	nodes := idx.removeTable(tableName)
+	for _, node := range nodes {
+		m.stats.resize(node.tableName, -1)
+	}
+	m.mutex.Unlock()
+
+	tc, ok := m.store.(tableClearer)
+	var res error
+	for _, node := range nodes {
+		if ok && !shared {
+			tc.delLocal(ctx, node.key)
+			continue
+		}
+		if err := storeDel(ctx, m.store, node.key); err != nil && err != ErrCacheMiss && res == nil {
+			res = err
+		}
+	}
+	if ok && shared {
+		kind := byte('p')
+		if idx == m.sqls {
+			kind = 's'
+		}
+		if err := tc.clearTable(ctx, tableName, kind); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// tableClearer is implemented by the stores shared by several cachers, whose
+// tables are cleared as a whole rather than by the keys a cacher knows
+type tableClearer interface {
+	clearTable(ctx context.Context, tableName string, kind byte) error
+	// delLocal deletes key from the part of the store owned by the cacher
+	delLocal(ctx context.Context, key string)
+}
+
+// index and unindex are called with the mutex held
+func (m *LRUCacher) index(idx *cacheIndex, tableName, key string) {
+	if idx.touch(tableName, key) {
+		m.stats.resize(tableName, 1)
+	}
+}
+
+func (m *LRUCacher) unindex(idx *cacheIndex, tableName, key string) {
+	if idx.remove(tableName, key) {
+		m.stats.resize(tableName, -1)
+	}
+}
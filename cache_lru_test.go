@@ -0,0 +1,188 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLRUCacher(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+
+	cacher.PutIds("user", "select id from user", "ids1")
+	cacher.PutIds("order", "select id from order", "ids2")
+	cacher.PutBean("user", "1", "bean1")
+	cacher.PutBean("order", "1", "bean2")
+
+	if v, err := store.Get("user-p-1"); err != nil || v != "bean1" {
+		t.Fatal("bean should be stored with key user-p-1, got", v, err)
+	}
+	if cacher.GetIds("user", "select id from user") != "ids1" {
+		t.Fatal("ids of user should be cached")
+	}
+
+	cacher.ClearIds("user")
+	if cacher.GetIds("user", "select id from user") != nil {
+		t.Fatal("ids of user should be cleared")
+	}
+	if cacher.GetIds("order", "select id from order") != "ids2" {
+		t.Fatal("ids of order should not be cleared")
+	}
+	if cacher.GetBean("user", "1") != "bean1" {
+		t.Fatal("beans of user should not be cleared by ClearIds")
+	}
+
+	cacher.ClearBeans("user")
+	if cacher.GetBean("user", "1") != nil {
+		t.Fatal("beans of user should be cleared")
+	}
+	if cacher.GetBean("order", "1") != "bean2" {
+		t.Fatal("beans of order should not be cleared")
+	}
+
+	cacher.DelBean("order", "1")
+	if cacher.GetBean("order", "1") != nil {
+		t.Fatal("bean should be deleted")
+	}
+}
+
+func TestLRUCacherMaxElementSize(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 2)
+
+	cacher.PutBean("user", "1", 1)
+	cacher.PutBean("user", "2", 2)
+	cacher.GetBean("user", "1")
+	cacher.PutBean("user", "3", 3)
+
+	if cacher.GetBean("user", "2") != nil {
+		t.Fatal("bean 2 should be evicted")
+	}
+	if store.Len() != 2 {
+		t.Fatal("store should keep 2 entries, got", store.Len())
+	}
+	if cacher.GetBean("user", "1") != 1 || cacher.GetBean("user", "3") != 3 {
+		t.Fatal("bean 1 and 3 should be kept")
+	}
+}
+
+func TestLRUCacherStats(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 2)
+
+	cacher.PutBean("user", "1", 1)
+	cacher.PutBean("user", "2", 2)
+	cacher.PutBean("order", "1", 1)
+	cacher.GetBean("user", "1")
+	cacher.GetBean("order", "1")
+	cacher.GetBean("order", "2")
+
+	stats := cacher.CacheStats()
+	if s := stats["user"]; s.Puts != 2 || s.Hits != 0 || s.Misses != 1 || s.Evictions != 1 || s.Size != 1 {
+		t.Fatal("unexpected user stats", s)
+	}
+	if s := stats["order"]; s.Puts != 1 || s.Hits != 1 || s.Misses != 1 || s.Size != 1 {
+		t.Fatal("unexpected order stats", s)
+	}
+	if s := store.CacheStats()["user"]; s.Puts != 2 || s.Size != 1 || s.Misses != 1 {
+		t.Fatal("unexpected store stats", s)
+	}
+
+	cacher.ResetCacheStats()
+	if s := cacher.CacheStats()["order"]; s != (CacheStats{Size: 1}) {
+		t.Fatal("counters should be reset but size, got", s)
+	}
+
+	cacher.ClearBeans("order")
+	if s := cacher.CacheStats()["order"]; s.Size != 0 {
+		t.Fatal("size should be 0 after clear, got", s)
+	}
+}
+
+type brokenStore struct{}
+
+func (brokenStore) Put(key string, value interface{}) error { return errBrokenStore }
+func (brokenStore) Get(key string) (interface{}, error)     { return nil, errBrokenStore }
+func (brokenStore) Del(key string) error                    { return errBrokenStore }
+
+var errBrokenStore = errors.New("broken store")
+
+func TestLRUCacherContext(t *testing.T) {
+	cacher := NewLRUCacher(brokenStore{}, 0)
+	if err := PutCacheSql(cacher, []PK{{1}}, "user", "select id from user", nil); err != errBrokenStore {
+		t.Fatal("store error should be returned by PutCacheSql, got", err)
+	}
+	if _, err := GetCacheSql(cacher, "user", "select id from user", nil); err != errBrokenStore {
+		t.Fatal("store error should be returned by GetCacheSql, got", err)
+	}
+	if err := cacher.ClearBeansContext(context.Background(), "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher = NewLRUCacher(store, 0)
+	if _, err := GetCacheSql(cacher, "user", "select id from user", nil); err != ErrCacheMiss {
+		t.Fatal("GetCacheSql should return ErrCacheMiss, got", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := cacher.PutBeanContext(ctx, "user", "1", 1); err != context.Canceled {
+		t.Fatal("PutBeanContext should return the context error, got", err)
+	}
+	if _, err := GetCacheSqlContext(ctx, cacher, "user", "select id from user", nil); err != context.Canceled {
+		t.Fatal("GetCacheSqlContext should return the context error, got", err)
+	}
+}
+
+// slowStore blocks the Gets of a key until release is closed
+type slowStore struct {
+	CacheStore
+	key     string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Get(key string) (interface{}, error) {
+	if key == s.key {
+		close(s.started)
+		<-s.release
+	}
+	return s.CacheStore.Get(key)
+}
+
+func TestLRUCacherSlowStore(t *testing.T) {
+	lru := NewLRUStore(0)
+	defer lru.Close()
+	store := &slowStore{lru, genBeanCacheKey("user", "1"), make(chan struct{}), make(chan struct{})}
+	cacher := NewLRUCacher(store, 0)
+	cacher.PutBean("user", "1", 1)
+	cacher.PutBean("order", "2", 2)
+
+	done := make(chan interface{})
+	go func() {
+		done <- cacher.GetBean("user", "1")
+	}()
+	<-store.started
+
+	// the other lookups do not wait for the slow one
+	if v := cacher.GetBean("order", "2"); v != 2 {
+		t.Fatal("unexpected bean", v)
+	}
+	cacher.PutBean("order", "3", 3)
+	cacher.ClearBeans("order")
+
+	close(store.release)
+	if v := <-done; v != 1 {
+		t.Fatal("unexpected bean", v)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"encoding/gob"
+	"time"
+)
+
+// NegativeCacher is implemented by Cachers which can remember for a short
+// time that a bean does not exist, so that looking it up again does not hit
+// the database. Such an entry is removed by PutBean, DelBean and ClearBeans.
+type NegativeCacher interface {
+	Cacher
+	PutBeanNotFound(tableName, id string)
+	IsBeanNotFound(tableName, id string) bool
+}
+
+// negativeEntry is stored in place of a bean which does not exist
+type negativeEntry struct {
+	ExpireAt time.Time
+}
+
+func init() {
+	// stores may encode their values, e.g. the shared one of a TieredStore
+	gob.Register(negativeEntry{})
+}
+
+func genNegativeCacheKey(tableName, id string) string {
+	return tableName + "-n-" + id
+}
+
+// PutBeanNotFound implements NegativeCacher, the entry expires from the store
+// after NegativeExpired when it is a SnapshotStore
+func (m *LRUCacher) PutBeanNotFound(tableName, id string) {
+	expired := m.NegativeExpired
+	if expired <= 0 {
+		expired = CacheNegativeExpired
+	}
+
+	ctx := context.Background()
+	m.del(ctx, m.ids, tableName, genBeanCacheKey(tableName, id))
+	m.PutTTL(genNegativeCacheKey(tableName, id), negativeEntry{time.Now().Add(expired)}, expired)
+}
+
+// IsBeanNotFound implements NegativeCacher
+func (m *LRUCacher) IsBeanNotFound(tableName, id string) bool {
+	ctx := context.Background()
+	key := genNegativeCacheKey(tableName, id)
+	v, err := storeGet(ctx, m.store, key)
+	if err != nil {
+		if err == ErrCacheMiss {
+			m.mutex.Lock()
+			m.unindex(m.ids, tableName, key)
+			m.mutex.Unlock()
+		}
+		return false
+	}
+	if entry, ok := v.(negativeEntry); !ok || !time.Now().Before(entry.ExpireAt) {
+		m.del(ctx, m.ids, tableName, key)
+		return false
+	}
+	m.mutex.Lock()
+	m.index(m.ids, tableName, key)
+	m.mutex.Unlock()
+	m.stats.negativeHit(tableName)
+	return true
+}
+
+// PutBeanNotFound implements NegativeCacher, the entry is recorded when the
+// Tx is committed
+func (m *TxCacher) PutBeanNotFound(tableName, id string) {
+	nc, ok := m.cacher.(NegativeCacher)
+	if !ok {
+		return
+	}
+	m.buffer(context.Background(), func() {}, func(ctx context.Context) error {
+		nc.PutBeanNotFound(tableName, id)
+		return nil
+	})
+}
+
+// IsBeanNotFound implements NegativeCacher
+func (m *TxCacher) IsBeanNotFound(tableName, id string) bool {
+	m.cache.mutex.Lock()
+	_, ok := m.beans.get(tableName, id)
+	m.cache.mutex.Unlock()
+	if ok {
+		// the bean may have been written by the Tx
+		return false
+	}
+	if nc, ok := m.cacher.(NegativeCacher); ok {
+		return nc.IsBeanNotFound(tableName, id)
+	}
+	return false
+}
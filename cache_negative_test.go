@@ -0,0 +1,90 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacherNegative(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+	cacher.NegativeExpired = 50 * time.Millisecond
+
+	cacher.PutBeanNotFound("user", "1")
+	if !cacher.IsBeanNotFound("user", "1") || cacher.IsBeanNotFound("user", "2") {
+		t.Fatal("only bean 1 should be known not to exist")
+	}
+	if cacher.GetBean("user", "1") != nil {
+		t.Fatal("a missing bean should not be returned by GetBean")
+	}
+
+	cacher.PutBean("user", "1", 1)
+	if cacher.IsBeanNotFound("user", "1") {
+		t.Fatal("PutBean should remove the negative entry")
+	}
+
+	cacher.PutBeanNotFound("user", "1")
+	if cacher.GetBean("user", "1") != nil {
+		t.Fatal("PutBeanNotFound should remove the bean")
+	}
+	cacher.DelBean("user", "1")
+	if cacher.IsBeanNotFound("user", "1") {
+		t.Fatal("DelBean should remove the negative entry")
+	}
+
+	cacher.PutBeanNotFound("user", "1")
+	cacher.ClearBeans("user")
+	if cacher.IsBeanNotFound("user", "1") {
+		t.Fatal("ClearBeans should remove the negative entry")
+	}
+
+	store.Expired = time.Hour
+	cacher.PutBeanNotFound("user", "1")
+	store.mutex.Lock()
+	expireAt := store.index[genNegativeCacheKey("user", "1")].Value.(*storeNode).expireAt
+	store.mutex.Unlock()
+	if expireAt.After(time.Now().Add(cacher.NegativeExpired)) {
+		t.Fatal("the negative entry should expire from the store after NegativeExpired, at", expireAt)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cacher.IsBeanNotFound("user", "1") {
+		t.Fatal("the negative entry should expire")
+	}
+	if store.Len() != 0 {
+		t.Fatal("the expired negative entry should be removed, got", store.Len())
+	}
+}
+
+func TestGetCacheBeanOrLoadNegative(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+
+	var loads int
+	load := func() (interface{}, error) {
+		loads++
+		return nil, nil
+	}
+	for i := 0; i < 3; i++ {
+		bean, err := GetCacheBeanOrLoad(cacher, "user", "1", load)
+		if bean != nil || err != nil {
+			t.Fatal("a missing bean should be nil without error, got", bean, err)
+		}
+	}
+	if loads != 1 {
+		t.Fatal("a missing bean should be loaded once, got", loads)
+	}
+	if s := cacher.CacheStats()["user"]; s.Hits != 0 || s.Misses != 3 || s.NegativeHits != 2 {
+		t.Fatalf("the negative lookups should be counted once as misses, got %+v", s)
+	}
+
+	cacher.PutBean("user", "1", 1)
+	if bean, err := GetCacheBeanOrLoad(cacher, "user", "1", load); bean != 1 || err != nil {
+		t.Fatal("the put bean should be returned, got", bean, err)
+	}
+}
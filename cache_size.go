@@ -0,0 +1,82 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"reflect"
+)
+
+// CacheSizer could be implemented by cached values to report their own size
+// in bytes instead of the reflection based estimation
+type CacheSizer interface {
+	CacheSize() int64
+}
+
+// CacheSizeOf estimates the number of bytes value occupies in memory
+func CacheSizeOf(value interface{}) int64 {
+	if value == nil {
+		return 0
+	}
+	if s, ok := value.(CacheSizer); ok {
+		return s.CacheSize()
+	}
+	v := reflect.ValueOf(value)
+	return int64(v.Type().Size()) + sizeOfIndirect(v, make(map[uintptr]bool))
+}
+
+// sizeOfIndirect returns the bytes v references out of its own value
+func sizeOfIndirect(v reflect.Value, visited map[uintptr]bool) int64 {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || visited[v.Pointer()] {
+			return 0
+		}
+		visited[v.Pointer()] = true
+		return int64(v.Type().Elem().Size()) + sizeOfIndirect(v.Elem(), visited)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		e := v.Elem()
+		return int64(e.Type().Size()) + sizeOfIndirect(e, visited)
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || visited[v.Pointer()] {
+			return 0
+		}
+		visited[v.Pointer()] = true
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += sizeOfIndirect(v.Index(i), visited)
+		}
+		return size
+	case reflect.Array:
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += sizeOfIndirect(v.Index(i), visited)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += sizeOfIndirect(v.Field(i), visited)
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() || visited[v.Pointer()] {
+			return 0
+		}
+		visited[v.Pointer()] = true
+		var size int64
+		iter := v.MapRange()
+		for iter.Next() {
+			k, e := iter.Key(), iter.Value()
+			size += int64(k.Type().Size()+e.Type().Size()) + sizeOfIndirect(k, visited) + sizeOfIndirect(e, visited)
+		}
+		return size
+	}
+	return 0
+}
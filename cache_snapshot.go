@@ -0,0 +1,358 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SnapshotStore is implemented by the stores, such as LRUStore and LRUCacher,
+// whose entries can be exported with ExportCache and imported with ImportCache
+type SnapshotStore interface {
+	// Range calls fn for all the live entries, from the least to the most
+	// recently used one, with their remaining time to live or 0 when they
+	// never expire, until fn returns false
+	Range(fn func(key string, value interface{}, ttl time.Duration) bool)
+	// PutTTL stores value under key for ttl, 0 means never expires
+	PutTTL(key string, value interface{}, ttl time.Duration) error
+}
+
+var (
+	cacheTypes     = make(map[string]reflect.Type)
+	cacheTypeNames = make(map[reflect.Type]string)
+	cacheTypeMutex sync.RWMutex
+)
+
+// RegisterCacheType registers the type of value, usually a bean pointer, under
+// name so that the cached values of this type could be exported. The name must
+// be the same in the process importing them.
+func RegisterCacheType(name string, value interface{}) {
+	t := reflect.TypeOf(value)
+	cacheTypeMutex.Lock()
+	defer cacheTypeMutex.Unlock()
+	if _, ok := builtinCacheTypes[name]; ok {
+		panic("core: RegisterCacheType of builtin type name " + name)
+	}
+	cacheTypes[name] = t
+	cacheTypeNames[t] = name
+}
+
+// builtinCacheTypes are the types of the values stored by LRUCacher itself
+var builtinCacheTypes = map[string]reflect.Type{
+	"ids":      StringType,
+	"notfound": reflect.TypeOf(negativeEntry{}),
+}
+
+var builtinCacheTypeNames = func() map[reflect.Type]string {
+	res := make(map[reflect.Type]string, len(builtinCacheTypes))
+	for name, t := range builtinCacheTypes {
+		res[t] = name
+	}
+	return res
+}()
+
+func cacheTypeName(t reflect.Type) (string, bool) {
+	if name, ok := builtinCacheTypeNames[t]; ok {
+		return name, true
+	}
+	cacheTypeMutex.RLock()
+	defer cacheTypeMutex.RUnlock()
+	name, ok := cacheTypeNames[t]
+	return name, ok
+}
+
+func cacheType(name string) (reflect.Type, bool) {
+	if t, ok := builtinCacheTypes[name]; ok {
+		return t, true
+	}
+	cacheTypeMutex.RLock()
+	defer cacheTypeMutex.RUnlock()
+	t, ok := cacheTypes[name]
+	return t, ok
+}
+
+const (
+	snapshotMagic = "xorm-cache-snapshot-1\n"
+	// the longest key or value accepted in a snapshot
+	snapshotMaxLen = 1 << 30
+)
+
+// ErrBadSnapshot is returned by ImportCache when its input is not a snapshot
+var ErrBadSnapshot = errors.New("xorm/cache: bad snapshot")
+
+// ExportCache writes the live entries of store to w, their values encoded by
+// codec but the id lists, which are kept encoded by the Codec of their cacher,
+// and returns how many were written. Values whose type is not
+// registered by RegisterCacheType are skipped.
+func ExportCache(w io.Writer, store SnapshotStore, codec Codec) (int, error) {
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	buf = append(buf, snapshotMagic...)
+	buf = binary.AppendVarint(buf, time.Now().UnixNano())
+	if _, err := bw.Write(buf); err != nil {
+		return 0, err
+	}
+
+	var n int
+	var err error
+	store.Range(func(key string, value interface{}, ttl time.Duration) bool {
+		name, ok := cacheTypeName(reflect.TypeOf(value))
+		if !ok {
+			return true
+		}
+		var data []byte
+		if data, err = encodeCacheValue(codec, name, value); err != nil {
+			err = fmt.Errorf("xorm/cache: export %s: %v", key, err)
+			return false
+		}
+
+		buf = buf[:0]
+		buf = appendSnapshotString(buf, key)
+		buf = appendSnapshotString(buf, name)
+		buf = binary.AppendVarint(buf, int64(ttl))
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		if _, err = bw.Write(buf); err != nil {
+			return false
+		}
+		if _, err = bw.Write(data); err != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// ImportCache puts the entries written by ExportCache into store and returns
+// how many were put. The time elapsed since the export is deducted from their
+// time to live and the entries which expired meanwhile are skipped, as well
+// as the ones the store does not accept.
+func ImportCache(r io.Reader, store SnapshotStore, codec Codec) (int, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != snapshotMagic {
+		return 0, ErrBadSnapshot
+	}
+	exportedAt, err := binary.ReadVarint(br)
+	if err != nil {
+		return 0, ErrBadSnapshot
+	}
+	elapsed := time.Since(time.Unix(0, exportedAt))
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	var n int
+	for {
+		key, err := readSnapshotString(br)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		name, err := readSnapshotString(br)
+		if err != nil {
+			return n, err
+		}
+		ttl, err := binary.ReadVarint(br)
+		if err != nil {
+			return n, snapshotError(err)
+		}
+		data, err := readSnapshotBytes(br)
+		if err != nil {
+			return n, err
+		}
+
+		t, ok := cacheType(name)
+		if !ok {
+			return n, fmt.Errorf("xorm/cache: import %s: unregistered type %s", key, name)
+		}
+		remaining := time.Duration(ttl)
+		if remaining > 0 {
+			if remaining -= elapsed; remaining <= 0 {
+				continue
+			}
+		}
+		value, err := decodeCacheValue(codec, name, t, data)
+		if err != nil {
+			return n, fmt.Errorf("xorm/cache: import %s: %v", key, err)
+		}
+		if err = store.PutTTL(key, value, remaining); err != nil {
+			if err == ErrNotStored {
+				continue
+			}
+			return n, err
+		}
+		n++
+	}
+}
+
+// ExportCacheFile writes the snapshot of store to the file path, which is
+// replaced only once the whole snapshot is written
+func ExportCacheFile(path string, store SnapshotStore, codec Codec) (int, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	n, err := ExportCache(f, store, codec)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return n, nil
+}
+
+// ImportCacheFile imports the snapshot written to the file path by ExportCacheFile
+func ImportCacheFile(path string, store SnapshotStore, codec Codec) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return ImportCache(f, store, codec)
+}
+
+// encodeCacheValue encodes value with codec but the id lists, which are
+// already encoded by the Codec of their cacher and are written as they are
+func encodeCacheValue(codec Codec, name string, value interface{}) ([]byte, error) {
+	if name == "ids" {
+		return []byte(value.(string)), nil
+	}
+	return codec.Marshal(value)
+}
+
+func decodeCacheValue(codec Codec, name string, t reflect.Type, data []byte) (interface{}, error) {
+	if name == "ids" {
+		return string(data), nil
+	}
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err := codec.Unmarshal(data, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Interface(), nil
+	}
+	v := reflect.New(t)
+	if err := codec.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	return v.Elem().Interface(), nil
+}
+
+func appendSnapshotString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readSnapshotString(r *bufio.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return "", io.EOF
+	}
+	if err != nil {
+		return "", snapshotError(err)
+	}
+	if l > snapshotMaxLen {
+		return "", ErrBadSnapshot
+	}
+	buf := make([]byte, l)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return "", snapshotError(err)
+	}
+	return string(buf), nil
+}
+
+func readSnapshotBytes(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+	if l > snapshotMaxLen {
+		return nil, ErrBadSnapshot
+	}
+	buf := make([]byte, l)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, snapshotError(err)
+	}
+	return buf, nil
+}
+
+// snapshotError reports a snapshot cut in the middle of an entry as ErrBadSnapshot
+func snapshotError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrBadSnapshot
+	}
+	return err
+}
+
+// Range implements SnapshotStore for the entries indexed by the cacher, its
+// store has to be a SnapshotStore. The id lists depending on other tables are
+// skipped since their dependencies are not part of a snapshot.
+func (m *LRUCacher) Range(fn func(key string, value interface{}, ttl time.Duration) bool) {
+	store, ok := m.store.(SnapshotStore)
+	if !ok {
+		return
+	}
+	store.Range(func(key string, value interface{}, ttl time.Duration) bool {
+		if !m.exportable(key) {
+			return true
+		}
+		return fn(key, value, ttl)
+	})
+}
+
+func (m *LRUCacher) exportable(key string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	tableName, kind := splitCacheKey(key)
+	if kind == 's' {
+		e, ok := m.sqls.tables[tableName][key]
+		return ok && len(e.Value.(*cacheNode).deps) == 0
+	}
+	_, ok := m.ids.tables[tableName][key]
+	return ok
+}
+
+// PutTTL implements SnapshotStore, the entry is indexed like the ones put
+// by PutIds, PutBean or PutBeanNotFound according to its key. When the store
+// is not a SnapshotStore, it is stored with the store's own expiration.
+func (m *LRUCacher) PutTTL(key string, value interface{}, ttl time.Duration) error {
+	tableName, kind := splitCacheKey(key)
+	if kind == 0 {
+		return ErrNotStored
+	}
+	idx := m.ids
+	if kind == 's' {
+		idx = m.sqls
+	}
+
+	ctx := context.Background()
+	return m.insert(ctx, idx, tableName, key, func() error {
+		if store, ok := m.store.(SnapshotStore); ok {
+			return store.PutTTL(key, value, ttl)
+		}
+		return storePut(ctx, m.store, key, value)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type snapshotUser struct {
+	Id   int64
+	Name string
+}
+
+func init() {
+	RegisterCacheType("core.snapshotUser", new(snapshotUser))
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	for _, codec := range []Codec{GobCodec, JSONCodec, BinaryCodec} {
+		store := NewLRUStore(0)
+		cacher := NewLRUCacher(store, 0)
+		cacher.SetCodec(codec)
+		cacher.PutBean("user", "1", &snapshotUser{Id: 1, Name: "xlw"})
+		cacher.PutBeanNotFound("user", "2")
+		if err := PutCacheSql(cacher, []PK{{int64(1)}}, "user", "select id from user", nil); err != nil {
+			t.Fatal(err)
+		}
+		// depends on the order table, so not exported
+		if err := PutCacheSql(cacher, []PK{{int64(1)}}, "user", "select user.id from user join `order` on user.id = `order`.user_id", nil); err != nil {
+			t.Fatal(err)
+		}
+		// not registered
+		cacher.PutBean("user", "3", struct{ Id int }{3})
+		store.PutTTL("user-p-4", &snapshotUser{Id: 4}, time.Millisecond)
+		time.Sleep(2 * time.Millisecond)
+
+		var buf bytes.Buffer
+		n, err := ExportCache(&buf, cacher, codec)
+		if err != nil || n != 3 {
+			t.Fatal("3 entries should be exported, got", n, err)
+		}
+		store.Close()
+
+		store = NewLRUStore(0)
+		cacher = NewLRUCacher(store, 0)
+		cacher.SetCodec(codec)
+		if n, err = ImportCache(&buf, cacher, codec); err != nil || n != 3 {
+			t.Fatal("3 entries should be imported, got", n, err)
+		}
+		if user, ok := cacher.GetBean("user", "1").(*snapshotUser); !ok || user.Name != "xlw" {
+			t.Fatal("the bean should be imported, got", cacher.GetBean("user", "1"))
+		}
+		if !cacher.IsBeanNotFound("user", "2") {
+			t.Fatal("the negative entry should be imported")
+		}
+		if ids, err := GetCacheSql(cacher, "user", "select id from user", nil); err != nil || len(ids) != 1 || ids[0][0] != int64(1) {
+			t.Fatal("the ids should be imported, got", ids, err)
+		}
+
+		cacher.ClearBeans("user")
+		cacher.ClearIds("user")
+		if store.Len() != 0 {
+			t.Fatal("the imported entries should be indexed by the cacher, got", store.Len())
+		}
+		store.Close()
+	}
+}
+
+func TestCacheSnapshotCodecs(t *testing.T) {
+	ids := []PK{{int64(1), "a"}}
+	for _, codecs := range [][2]Codec{{GobCodec, JSONCodec}, {BinaryCodec, JSONCodec}, {JSONCodec, GobCodec}} {
+		store := NewLRUStore(0)
+		cacher := NewLRUCacher(store, 0)
+		cacher.SetCodec(codecs[0])
+		if err := PutCacheSql(cacher, ids, "user", "select id from user", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		var buf bytes.Buffer
+		if n, err := ExportCache(&buf, cacher, codecs[1]); err != nil || n != 1 {
+			t.Fatal("1 entry should be exported, got", n, err)
+		}
+		store.Close()
+
+		store = NewLRUStore(0)
+		cacher = NewLRUCacher(store, 0)
+		cacher.SetCodec(codecs[0])
+		if n, err := ImportCache(&buf, cacher, codecs[1]); err != nil || n != 1 {
+			t.Fatal("1 entry should be imported, got", n, err)
+		}
+		if res, err := GetCacheSql(cacher, "user", "select id from user", nil); err != nil || !reflect.DeepEqual(res, ids) {
+			t.Errorf("%T ids exported with %T should be imported, got %v %v", codecs[0], codecs[1], res, err)
+		}
+		store.Close()
+	}
+}
+
+func TestCacheSnapshotFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "xorm-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+
+	store := NewLRUStore(0)
+	defer store.Close()
+	store.PutTTL("user-p-1", &snapshotUser{Id: 1}, 0)
+	store.PutTTL("user-p-2", &snapshotUser{Id: 2}, time.Hour)
+	if n, err := ExportCacheFile(path, store, GobCodec); err != nil || n != 2 {
+		t.Fatal("2 entries should be exported, got", n, err)
+	}
+
+	imported := NewLRUStore(0)
+	defer imported.Close()
+	if n, err := ImportCacheFile(path, imported, GobCodec); err != nil || n != 2 {
+		t.Fatal("2 entries should be imported, got", n, err)
+	}
+	imported.Range(func(key string, value interface{}, ttl time.Duration) bool {
+		if key == "user-p-1" && ttl != 0 || key == "user-p-2" && (ttl <= 0 || ttl > time.Hour) {
+			t.Fatal("unexpected ttl of", key, ttl)
+		}
+		return true
+	})
+
+	if _, err := ImportCache(strings.NewReader("not a snapshot"), imported, GobCodec); err != ErrBadSnapshot {
+		t.Fatal("ErrBadSnapshot should be returned, got", err)
+	}
+	data, _ := os.ReadFile(path)
+	if _, err := ImportCache(bytes.NewReader(data[:len(data)-1]), imported, GobCodec); err != ErrBadSnapshot {
+		t.Fatal("ErrBadSnapshot should be returned for a truncated snapshot, got", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"strings"
+	"sync"
+)
+
+// CacheStats is the statistics of one table's cache entries
+type CacheStats struct {
+	Hits        int64
+	Misses      int64
+	Puts        int64
+	Evictions   int64
+	Expirations int64
+	// NegativeHits is the number of the misses of beans known not to exist
+	// by PutBeanNotFound
+	NegativeHits int64
+	// Size is the current number of entries
+	Size int64
+}
+
+// CacheStatsReporter is an optional interface which Cachers and CacheStores
+// could implement to report their statistics
+type CacheStatsReporter interface {
+	// CacheStats returns a snapshot of the statistics keyed by table name
+	CacheStats() map[string]CacheStats
+	// ResetCacheStats resets all the counters except Size
+	ResetCacheStats()
+}
+
+// cacheStats is a concurrency-safe recorder of per table statistics
+type cacheStats struct {
+	mutex  sync.Mutex
+	tables map[string]*CacheStats
+}
+
+func (c *cacheStats) record(tableName string, f func(s *CacheStats)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.tables == nil {
+		c.tables = make(map[string]*CacheStats)
+	}
+	s, ok := c.tables[tableName]
+	if !ok {
+		s = &CacheStats{}
+		c.tables[tableName] = s
+	}
+	f(s)
+}
+
+func (c *cacheStats) hit(tableName string) {
+	c.record(tableName, func(s *CacheStats) { s.Hits++ })
+}
+
+func (c *cacheStats) miss(tableName string) {
+	c.record(tableName, func(s *CacheStats) { s.Misses++ })
+}
+
+func (c *cacheStats) negativeHit(tableName string) {
+	c.record(tableName, func(s *CacheStats) { s.NegativeHits++ })
+}
+
+func (c *cacheStats) put(tableName string) {
+	c.record(tableName, func(s *CacheStats) { s.Puts++ })
+}
+
+func (c *cacheStats) evict(tableName string) {
+	c.record(tableName, func(s *CacheStats) { s.Evictions++ })
+}
+
+func (c *cacheStats) expire(tableName string) {
+	c.record(tableName, func(s *CacheStats) { s.Expirations++ })
+}
+
+func (c *cacheStats) resize(tableName string, delta int64) {
+	c.record(tableName, func(s *CacheStats) { s.Size += delta })
+}
+
+func (c *cacheStats) snapshot() map[string]CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := make(map[string]CacheStats, len(c.tables))
+	for tableName, s := range c.tables {
+		res[tableName] = *s
+	}
+	return res
+}
+
+func (c *cacheStats) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for tableName, s := range c.tables {
+		if s.Size == 0 {
+			delete(c.tables, tableName)
+			continue
+		}
+		c.tables[tableName] = &CacheStats{Size: s.Size}
+	}
+}
+
+// tableOfCacheKey returns the table name of a key of the
+// <tablename>-p-<pk> or <tablename>-s-<sql> layout, or an empty string
+func tableOfCacheKey(key string) string {
+	tableName, _ := splitCacheKey(key)
+	return tableName
+}
+
+// splitCacheKey returns the table of key and its kind: 'p' for beans, 's'
+// for SQL id lists and 'n' for missing beans, or 0 when key is not a cache key
+func splitCacheKey(key string) (string, byte) {
+	i := -1
+	for _, sep := range []string{"-p-", "-s-", "-n-"} {
+		if j := strings.Index(key, sep); j >= 0 && (i < 0 || j < i) {
+			i = j
+		}
+	}
+	if i < 0 {
+		return "", 0
+	}
+	return key[:i], key[i+1]
+}
@@ -0,0 +1,299 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type storeNode struct {
+	key      string
+	value    interface{}
+	size     int64
+	expireAt time.Time
+}
+
+func (n *storeNode) isExpired(now time.Time) bool {
+	return !n.expireAt.IsZero() && !now.Before(n.expireAt)
+}
+
+// LRUStore is a concurrency-safe in-memory CacheStore. Entries expire
+// Expired after they were stored and the least recently used entries are
+// dropped when MaxElementSize or MaxMemory, the estimated bytes of all the
+// keys and values, is exceeded. A background goroutine removes at most
+// GcMaxRemoved expired entries every GcInterval until Close is called.
+type LRUStore struct {
+	Expired        time.Duration
+	MaxElementSize int
+	MaxMemory      int64
+	GcInterval     time.Duration
+	GcMaxRemoved   int
+
+	mutex  sync.Mutex
+	list   *list.List
+	index  map[string]*list.Element
+	memory int64
+	closed bool
+	stop   chan struct{}
+	stats  cacheStats
+}
+
+// NewLRUStore creates a LRUStore which keeps at most maxElementSize entries
+// (0 means no limit) and CacheMaxMemory megabytes, and expires them after CacheExpired
+func NewLRUStore(maxElementSize int) *LRUStore {
+	return NewLRUStore2(CacheExpired, maxElementSize)
+}
+
+// NewLRUStore2 creates a LRUStore with the given expiration and size limit
+func NewLRUStore2(expired time.Duration, maxElementSize int) *LRUStore {
+	s := &LRUStore{
+		Expired:        expired,
+		MaxElementSize: maxElementSize,
+		MaxMemory:      CacheMaxMemory << 20,
+		GcInterval:     CacheGcInterval,
+		GcMaxRemoved:   CacheGcMaxRemoved,
+		list:           list.New(),
+		index:          make(map[string]*list.Element),
+		stop:           make(chan struct{}),
+	}
+	go s.gcLoop()
+	return s
+}
+
+func (s *LRUStore) gcLoop() {
+	timer := time.NewTimer(s.gcInterval())
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-timer.C:
+			s.GC()
+			timer.Reset(s.gcInterval())
+		}
+	}
+}
+
+func (s *LRUStore) gcInterval() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.GcInterval <= 0 {
+		return CacheGcInterval
+	}
+	return s.GcInterval
+}
+
+// GC removes at most GcMaxRemoved expired entries, starting from the least
+// recently used one, and returns how many were removed
+func (s *LRUStore) GC() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var removed int
+	for e := s.list.Back(); e != nil; {
+		if s.GcMaxRemoved > 0 && removed >= s.GcMaxRemoved {
+			break
+		}
+		prev := e.Prev()
+		if node := e.Value.(*storeNode); node.isExpired(now) {
+			s.removeElement(e)
+			s.stats.expire(tableOfCacheKey(node.key))
+			removed++
+		}
+		e = prev
+	}
+	return removed
+}
+
+// Put stores value under key, it returns ErrNotStored once the store is closed
+// or when the value alone is larger than MaxMemory
+func (s *LRUStore) Put(key string, value interface{}) error {
+	return s.put(key, value, s.Expired)
+}
+
+// PutTTL stores value under key like Put but expires it after ttl instead of
+// Expired, 0 means never
+func (s *LRUStore) PutTTL(key string, value interface{}, ttl time.Duration) error {
+	return s.put(key, value, ttl)
+}
+
+func (s *LRUStore) put(key string, value interface{}, ttl time.Duration) error {
+	size := int64(len(key)) + CacheSizeOf(value)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || (s.MaxMemory > 0 && size > s.MaxMemory) {
+		return ErrNotStored
+	}
+	tableName := tableOfCacheKey(key)
+	s.stats.put(tableName)
+
+	var expireAt time.Time
+	if ttl > 0 {
+		expireAt = time.Now().Add(ttl)
+	}
+
+	if e, ok := s.index[key]; ok {
+		node := e.Value.(*storeNode)
+		s.memory += size - node.size
+		node.value = value
+		node.size = size
+		node.expireAt = expireAt
+		s.list.MoveToFront(e)
+	} else {
+		s.index[key] = s.list.PushFront(&storeNode{key, value, size, expireAt})
+		s.memory += size
+		s.stats.resize(tableName, 1)
+	}
+
+	for (s.MaxElementSize > 0 && s.list.Len() > s.MaxElementSize) ||
+		(s.MaxMemory > 0 && s.memory > s.MaxMemory) {
+		e := s.list.Back()
+		s.removeElement(e)
+		s.stats.evict(tableOfCacheKey(e.Value.(*storeNode).key))
+	}
+	return nil
+}
+
+// Get returns the value of key or ErrCacheMiss when it is absent or expired
+func (s *LRUStore) Get(key string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tableName := tableOfCacheKey(key)
+	e, ok := s.index[key]
+	if !ok {
+		s.stats.miss(tableName)
+		return nil, ErrCacheMiss
+	}
+	node := e.Value.(*storeNode)
+	if node.isExpired(time.Now()) {
+		s.removeElement(e)
+		s.stats.expire(tableName)
+		s.stats.miss(tableName)
+		return nil, ErrCacheMiss
+	}
+	s.list.MoveToFront(e)
+	s.stats.hit(tableName)
+	return node.value, nil
+}
+
+// Del removes key, it returns ErrCacheMiss when key is absent
+func (s *LRUStore) Del(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e, ok := s.index[key]
+	if !ok {
+		return ErrCacheMiss
+	}
+	s.removeElement(e)
+	return nil
+}
+
+// PutContext implements CacheStoreContext
+func (s *LRUStore) PutContext(ctx context.Context, key string, value interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Put(key, value)
+}
+
+// GetContext implements CacheStoreContext
+func (s *LRUStore) GetContext(ctx context.Context, key string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Get(key)
+}
+
+// DelContext implements CacheStoreContext
+func (s *LRUStore) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Del(key)
+}
+
+// Range calls fn for all the live entries, from the least to the most
+// recently used one, with their remaining time to live or 0 when they never
+// expire, until fn returns false
+func (s *LRUStore) Range(fn func(key string, value interface{}, ttl time.Duration) bool) {
+	type entry struct {
+		key   string
+		value interface{}
+		ttl   time.Duration
+	}
+
+	s.mutex.Lock()
+	now := time.Now()
+	entries := make([]entry, 0, s.list.Len())
+	for e := s.list.Back(); e != nil; e = e.Prev() {
+		node := e.Value.(*storeNode)
+		if node.isExpired(now) {
+			continue
+		}
+		var ttl time.Duration
+		if !node.expireAt.IsZero() {
+			ttl = node.expireAt.Sub(now)
+		}
+		entries = append(entries, entry{node.key, node.value, ttl})
+	}
+	s.mutex.Unlock()
+
+	for _, e := range entries {
+		if !fn(e.key, e.value, e.ttl) {
+			return
+		}
+	}
+}
+
+// Len returns the number of entries including the expired ones not collected yet
+func (s *LRUStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.list.Len()
+}
+
+// Memory returns the estimated bytes of all the entries
+func (s *LRUStore) Memory() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.memory
+}
+
+// CacheStats implements CacheStatsReporter
+func (s *LRUStore) CacheStats() map[string]CacheStats {
+	return s.stats.snapshot()
+}
+
+// ResetCacheStats implements CacheStatsReporter
+func (s *LRUStore) ResetCacheStats() {
+	s.stats.reset()
+}
+
+// Close stops the background GC, later Put calls return ErrNotStored
+func (s *LRUStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.stop)
+	}
+	return nil
+}
+
+func (s *LRUStore) removeElement(e *list.Element) {
+	node := e.Value.(*storeNode)
+	s.list.Remove(e)
+	delete(s.index, node.key)
+	s.memory -= node.size
+	s.stats.resize(tableOfCacheKey(node.key), -1)
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLRUStore(t *testing.T) {
+	store := NewLRUStore(2)
+	defer store.Close()
+
+	if _, err := store.Get("a"); err != ErrCacheMiss {
+		t.Fatal("get of absent key should return ErrCacheMiss, got", err)
+	}
+
+	store.Put("a", 1)
+	store.Put("b", 2)
+	if v, err := store.Get("a"); err != nil || v != 1 {
+		t.Fatal("a should be 1, got", v, err)
+	}
+
+	// b is now the least recently used entry
+	store.Put("c", 3)
+	if _, err := store.Get("b"); err != ErrCacheMiss {
+		t.Fatal("b should have been evicted")
+	}
+	if store.Len() != 2 {
+		t.Fatal("store should keep 2 entries, got", store.Len())
+	}
+
+	if err := store.Del("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Del("a"); err != ErrCacheMiss {
+		t.Fatal("del of absent key should return ErrCacheMiss, got", err)
+	}
+
+	store.Close()
+	if err := store.Put("d", 4); err != ErrNotStored {
+		t.Fatal("put after close should return ErrNotStored, got", err)
+	}
+}
+
+func TestLRUStoreExpired(t *testing.T) {
+	store := NewLRUStore2(20*time.Millisecond, 0)
+	defer store.Close()
+	store.GcMaxRemoved = 2
+
+	for _, key := range []string{"a", "b", "c"} {
+		store.Put(key, key)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := store.Get("a"); err != ErrCacheMiss {
+		t.Fatal("a should be expired")
+	}
+	if n := store.GC(); n != 2 {
+		t.Fatal("gc should remove 2 nodes, removed", n)
+	}
+	if store.Len() != 0 {
+		t.Fatal("store should be empty, got", store.Len())
+	}
+}
+
+func TestLRUStoreMaxMemory(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+
+	bean := &User{Name: strings.Repeat("a", 100)}
+	size := int64(len("a")) + CacheSizeOf(bean)
+	if size < 100 {
+		t.Fatal("bean size should include its string fields, got", size)
+	}
+
+	store.MaxMemory = 2 * size
+	store.Put("a", bean)
+	store.Put("b", &User{Name: strings.Repeat("b", 100)})
+	store.Put("c", &User{Name: strings.Repeat("c", 100)})
+
+	if _, err := store.Get("a"); err != ErrCacheMiss {
+		t.Fatal("a should be evicted when memory is exceeded")
+	}
+	if store.Len() != 2 || store.Memory() != 2*size {
+		t.Fatal("store should keep 2 entries of", 2*size, "bytes, got", store.Len(), store.Memory())
+	}
+
+	if err := store.Put("d", strings.Repeat("d", int(3*size))); err != ErrNotStored {
+		t.Fatal("value larger than MaxMemory should not be stored, got", err)
+	}
+
+	store.Del("b")
+	store.Del("c")
+	if store.Memory() != 0 {
+		t.Fatal("memory should be released, got", store.Memory())
+	}
+}
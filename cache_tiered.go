@@ -0,0 +1,197 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// TieredStore is a CacheStore which keeps a small in-process LRUStore with a
+// short expiration in front of a shared CacheStore. Writes and deletions go
+// through to both tiers, reads fill the local tier from the shared one.
+//
+// Clearing a table of a LRUCacher bumps its generation in the shared tier,
+// which is part of the keys of its entries, so that the entries written by
+// the other replicas are invalidated too. The other replicas see the new
+// generation once their local tier expired it, as they see deletions. The id
+// lists of other tables depending on the table are only invalidated when
+// their replica knows them. The entries of the previous generations are not
+// deleted: they are written for SharedExpired when the shared store has a
+// PutTTL method, such as the SnapshotStores, and must otherwise be expired by
+// the shared store itself.
+type TieredStore struct {
+	// SharedExpired is how long the entries are kept by the shared tier when
+	// it has a PutTTL method, CacheExpired by default and 0 for ever
+	SharedExpired time.Duration
+
+	local  *LRUStore
+	shared CacheStore
+}
+
+// ttlStore is implemented by the stores whose entries expire after a ttl
+type ttlStore interface {
+	PutTTL(key string, value interface{}, ttl time.Duration) error
+}
+
+// NewTieredStore creates a TieredStore whose local tier keeps at most
+// localSize entries for localExpired
+func NewTieredStore(shared CacheStore, localSize int, localExpired time.Duration) *TieredStore {
+	return &TieredStore{
+		SharedExpired: CacheExpired,
+		local:         NewLRUStore2(localExpired, localSize),
+		shared:        shared,
+	}
+}
+
+// NewTieredCacher creates a LRUCacher on top of a TieredStore
+func NewTieredCacher(shared CacheStore, localSize int, localExpired time.Duration, maxElementSize int) *LRUCacher {
+	return NewLRUCacher(NewTieredStore(shared, localSize, localExpired), maxElementSize)
+}
+
+// Local returns the in-process tier
+func (s *TieredStore) Local() *LRUStore {
+	return s.local
+}
+
+// Shared returns the shared tier
+func (s *TieredStore) Shared() CacheStore {
+	return s.shared
+}
+
+// genKey is the key of the generation of the beans or the id lists of a table
+func genKey(tableName string, kind byte) string {
+	if kind != 's' {
+		kind = 'p'
+	}
+	return tableName + "-g" + string(kind)
+}
+
+// generation returns the generation of the kind of entries of the table, it
+// is empty until the table is cleared
+func (s *TieredStore) generation(ctx context.Context, tableName string, kind byte) (string, error) {
+	key := genKey(tableName, kind)
+	if v, err := s.local.GetContext(ctx, key); err == nil {
+		gen, _ := v.(string)
+		return gen, nil
+	}
+	v, err := storeGet(ctx, s.shared, key)
+	if err != nil && err != ErrCacheMiss {
+		return "", err
+	}
+	gen, _ := v.(string)
+	s.local.Put(key, gen)
+	return gen, nil
+}
+
+// tierKey returns the key of the tiers for the key of a LRUCacher, which has
+// the generation of its table after its kind
+func (s *TieredStore) tierKey(ctx context.Context, key string) (string, error) {
+	tableName, kind := splitCacheKey(key)
+	if tableName == "" {
+		return key, nil
+	}
+	gen, err := s.generation(ctx, tableName, kind)
+	if err != nil || gen == "" {
+		return key, err
+	}
+	i := len(tableName) + 2
+	return key[:i] + gen + key[i:], nil
+}
+
+// clearTable invalidates the beans, or the id lists when kind is 's', of the
+// table in all the replicas sharing the shared tier
+func (s *TieredStore) clearTable(ctx context.Context, tableName string, kind byte) error {
+	key := genKey(tableName, kind)
+	gen := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := storePut(ctx, s.shared, key, gen); err != nil {
+		s.local.Del(key)
+		return err
+	}
+	s.local.Put(key, gen)
+	return nil
+}
+
+// delLocal deletes key from the local tier only
+func (s *TieredStore) delLocal(ctx context.Context, key string) {
+	if key, err := s.tierKey(ctx, key); err == nil {
+		s.local.Del(key)
+	}
+}
+
+// Put implements CacheStore
+func (s *TieredStore) Put(key string, value interface{}) error {
+	return s.PutContext(context.Background(), key, value)
+}
+
+// Get implements CacheStore
+func (s *TieredStore) Get(key string) (interface{}, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// Del implements CacheStore
+func (s *TieredStore) Del(key string) error {
+	return s.DelContext(context.Background(), key)
+}
+
+// PutContext implements CacheStoreContext, the local tier is only written
+// once the shared one succeeded
+func (s *TieredStore) PutContext(ctx context.Context, key string, value interface{}) error {
+	key, err := s.tierKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	if ts, ok := s.shared.(ttlStore); ok {
+		if err = ctx.Err(); err == nil {
+			err = ts.PutTTL(key, value, s.SharedExpired)
+		}
+	} else {
+		err = storePut(ctx, s.shared, key, value)
+	}
+	if err != nil {
+		s.local.Del(key)
+		return err
+	}
+	s.local.Put(key, value)
+	return nil
+}
+
+// GetContext implements CacheStoreContext
+func (s *TieredStore) GetContext(ctx context.Context, key string) (interface{}, error) {
+	key, err := s.tierKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if v, err := s.local.GetContext(ctx, key); err != ErrCacheMiss {
+		return v, err
+	}
+	v, err := storeGet(ctx, s.shared, key)
+	if err != nil {
+		return nil, err
+	}
+	s.local.Put(key, v)
+	return v, nil
+}
+
+// DelContext implements CacheStoreContext, it returns ErrCacheMiss only when
+// key is in none of the tiers
+func (s *TieredStore) DelContext(ctx context.Context, key string) error {
+	key, err := s.tierKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	localErr := s.local.Del(key)
+	err = storeDel(ctx, s.shared, key)
+	if err == ErrCacheMiss && localErr == nil {
+		return nil
+	}
+	return err
+}
+
+// Close closes the local tier
+func (s *TieredStore) Close() error {
+	return s.local.Close()
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSharedStore is an in-process stand-in for a shared CacheStore
+type fakeSharedStore struct {
+	mutex sync.Mutex
+	data  map[string]interface{}
+	ttls  map[string]time.Duration
+	puts  map[string]int
+	gets  int
+}
+
+func newFakeSharedStore() *fakeSharedStore {
+	return &fakeSharedStore{
+		data: make(map[string]interface{}),
+		ttls: make(map[string]time.Duration),
+		puts: make(map[string]int),
+	}
+}
+
+func (s *fakeSharedStore) Put(key string, value interface{}) error {
+	return s.PutTTL(key, value, 0)
+}
+
+func (s *fakeSharedStore) PutTTL(key string, value interface{}, ttl time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data[key] = value
+	s.ttls[key] = ttl
+	s.puts[key]++
+	return nil
+}
+
+func (s *fakeSharedStore) Get(key string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gets++
+	v, ok := s.data[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return v, nil
+}
+
+func (s *fakeSharedStore) Del(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return ErrCacheMiss
+	}
+	delete(s.data, key)
+	return nil
+}
+
+func TestTieredCacher(t *testing.T) {
+	shared := newFakeSharedStore()
+	a := NewTieredCacher(shared, 10, time.Minute, 0)
+	b := NewTieredCacher(shared, 10, time.Minute, 0)
+	defer a.Store().(*TieredStore).Close()
+	defer b.Store().(*TieredStore).Close()
+
+	a.PutBean("user", "1", "bean1")
+	if _, err := shared.Get("user-p-1"); err != nil {
+		t.Fatal("bean should be written through to the shared store")
+	}
+
+	// b reads from the shared tier once and then from its local tier
+	if b.GetBean("user", "1") != "bean1" {
+		t.Fatal("bean should be read from the shared store")
+	}
+	gets := shared.gets
+	if b.GetBean("user", "1") != "bean1" || shared.gets != gets {
+		t.Fatal("the second read should hit the local tier, shared gets", shared.gets-gets)
+	}
+
+	b.DelBean("user", "1")
+	if _, err := shared.Get("user-p-1"); err != ErrCacheMiss {
+		t.Fatal("bean should be deleted from the shared store")
+	}
+	if _, err := b.Store().(*TieredStore).Local().Get("user-p-1"); err != ErrCacheMiss {
+		t.Fatal("bean should be deleted from the local tier")
+	}
+
+	b.PutBean("user", "2", "bean2")
+	b.ClearBeans("user")
+	if _, err := shared.Get("user-p-2"); err != ErrCacheMiss {
+		t.Fatal("bean should be deleted from the shared store")
+	}
+	if _, err := b.Store().(*TieredStore).Local().Get("user-p-2"); err != ErrCacheMiss {
+		t.Fatal("bean should be deleted from the local tier")
+	}
+}
+
+func TestTieredCacherClearReplicas(t *testing.T) {
+	shared := newFakeSharedStore()
+	a := NewTieredCacher(shared, 10, time.Minute, 0)
+	b := NewTieredCacher(shared, 10, time.Minute, 0)
+	defer a.Store().(*TieredStore).Close()
+	defer b.Store().(*TieredStore).Close()
+
+	a.PutBean("user", "1", "bean1")
+	a.PutIds("user", "select id from user", "ids")
+	b.ClearBeans("user")
+	b.ClearIds("user")
+	if b.GetBean("user", "1") != nil || b.GetIds("user", "select id from user") != nil {
+		t.Fatal("the entries written by a should be cleared by b")
+	}
+	// the entries of the previous generation are left to expire
+	if _, err := shared.Get("user-p-1"); err != nil || shared.ttls["user-p-1"] != CacheExpired {
+		t.Fatal("the bean of the previous generation should expire from the shared store, ttl", shared.ttls["user-p-1"], err)
+	}
+	if shared.ttls[genKey("user", 'p')] != 0 {
+		t.Fatal("the generation should outlive the entries")
+	}
+
+	// a sees the clear once its local tier expired the generations
+	local := a.Store().(*TieredStore).Local()
+	local.Del(genKey("user", 'p'))
+	local.Del(genKey("user", 's'))
+	if a.GetBean("user", "1") != nil || a.GetIds("user", "select id from user") != nil {
+		t.Fatal("the entries written by a should be cleared for a too")
+	}
+
+	a.PutBean("user", "1", "bean2")
+	if b.GetBean("user", "1") != "bean2" {
+		t.Fatal("the entries written after the clear should be shared")
+	}
+}
+
+func TestTieredCacherBus(t *testing.T) {
+	shared := newFakeSharedStore()
+	bus := NewLocalBus()
+	defer bus.Close()
+	a := NewTieredCacher(shared, 10, time.Minute, 0)
+	b := NewTieredCacher(shared, 10, time.Minute, 0)
+	defer a.Store().(*TieredStore).Close()
+	defer b.Store().(*TieredStore).Close()
+	a.SetBus(bus)
+	b.SetBus(bus)
+	defer a.SetBus(nil)
+	defer b.SetBus(nil)
+
+	a.PutBean("user", "1", "bean1")
+	if b.GetBean("user", "1") != "bean1" {
+		t.Fatal("bean should be read from the shared store")
+	}
+	b.ClearBeans("user")
+	if shared.puts[genKey("user", 'p')] != 1 {
+		t.Fatal("the generation should be bumped once, got", shared.puts[genKey("user", 'p')])
+	}
+	if a.GetBean("user", "1") != nil {
+		t.Fatal("the invalidation should drop the local tier of a")
+	}
+
+	// the invalidations only drop the local state of the other replicas
+	b.PutBean("user", "2", "bean2")
+	a.PutBean("user", "2", "bean2")
+	bus.Publish(Invalidation{Op: InvalidateAll})
+	if _, err := shared.Get("user-p" + shared.data[genKey("user", 'p')].(string) + "-2"); err != nil {
+		t.Fatal("InvalidateAll should keep the shared entries, got", err)
+	}
+	if shared.puts[genKey("user", 'p')] != 1 {
+		t.Fatal("InvalidateAll should not bump the generation")
+	}
+}
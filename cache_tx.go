@@ -0,0 +1,327 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"context"
+	"sync"
+)
+
+// txCache holds the cache operations of a Tx until it is committed
+type txCache struct {
+	mutex   sync.Mutex
+	ops     []func(ctx context.Context) error
+	cachers map[string]*TxCacher
+	done    bool
+}
+
+func (c *txCache) add(op func(ctx context.Context) error) {
+	c.ops = append(c.ops, op)
+}
+
+// finish ends the Tx, the buffered operations are returned when committed
+// and dropped otherwise
+func (c *txCache) finish(committed bool) []func(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ops := c.ops
+	c.ops = nil
+	c.done = true
+	if !committed {
+		return nil
+	}
+	return ops
+}
+
+type txEntry struct {
+	value   interface{}
+	deleted bool
+}
+
+// txView is what a Tx sees of a cacher: its own writes over the cacher's
+type txView struct {
+	entries map[string]map[string]txEntry
+	cleared map[string]bool
+}
+
+func newTxView() *txView {
+	return &txView{
+		entries: make(map[string]map[string]txEntry),
+		cleared: make(map[string]bool),
+	}
+}
+
+// get returns the entry written in the Tx, ok is false when the cacher has
+// to be looked up
+func (v *txView) get(tableName, key string) (entry txEntry, ok bool) {
+	if entry, ok = v.entries[tableName][key]; ok {
+		return entry, true
+	}
+	if v.cleared[tableName] {
+		return txEntry{deleted: true}, true
+	}
+	return txEntry{}, false
+}
+
+func (v *txView) set(tableName, key string, entry txEntry) {
+	entries, ok := v.entries[tableName]
+	if !ok {
+		entries = make(map[string]txEntry)
+		v.entries[tableName] = entries
+	}
+	entries[key] = entry
+}
+
+func (v *txView) clear(tableName string) {
+	delete(v.entries, tableName)
+	v.cleared[tableName] = true
+}
+
+// TxCacher is the Cacher of a Tx. Its puts, deletions and clears are applied
+// to the wrapped Cacher only when the Tx is committed and dropped when it is
+// rolled back, so that other readers never see the cache of uncommitted
+// data. The Tx itself sees its own writes.
+type TxCacher struct {
+	cacher Cacher
+	cache  *txCache
+	ids    *txView
+	beans  *txView
+	// ClearIds of a table may remove the ids of other tables depending on it
+	clearedDeps bool
+}
+
+// Cacher returns the Cacher to use in place of c during the Tx
+func (tx *Tx) Cacher(c Cacher) *TxCacher {
+	if c == nil {
+		return nil
+	}
+	if tc, ok := c.(*TxCacher); ok && tc.cache == tx.cache {
+		return tc
+	}
+
+	tx.cache.mutex.Lock()
+	defer tx.cache.mutex.Unlock()
+	if tx.cache.cachers == nil {
+		tx.cache.cachers = make(map[string]*TxCacher)
+	}
+	id := cacherID(c)
+	tc, ok := tx.cache.cachers[id]
+	if !ok {
+		tc = &TxCacher{
+			cacher: c,
+			cache:  tx.cache,
+			ids:    newTxView(),
+			beans:  newTxView(),
+		}
+		tx.cache.cachers[id] = tc
+	}
+	return tc
+}
+
+// Cacher returns the wrapped Cacher
+func (m *TxCacher) Cacher() Cacher {
+	return m.cacher
+}
+
+// Codec implements CodecCacher, the ids are encoded as the wrapped Cacher does
+func (m *TxCacher) Codec() Codec {
+	return cacherCodec(m.cacher)
+}
+
+// DBType implements DBTypeCacher, the SQL keys are normalized as the wrapped
+// Cacher does
+func (m *TxCacher) DBType() DbType {
+	return cacherDBType(m.cacher)
+}
+
+// GetIds implements Cacher
+func (m *TxCacher) GetIds(tableName, sql string) interface{} {
+	v, _ := m.GetIdsContext(context.Background(), tableName, sql)
+	return v
+}
+
+// GetBean implements Cacher
+func (m *TxCacher) GetBean(tableName, id string) interface{} {
+	v, _ := m.GetBeanContext(context.Background(), tableName, id)
+	return v
+}
+
+// PutIds implements Cacher
+func (m *TxCacher) PutIds(tableName, sql string, ids interface{}) {
+	m.PutIdsContext(context.Background(), tableName, sql, ids)
+}
+
+// PutBean implements Cacher
+func (m *TxCacher) PutBean(tableName, id string, obj interface{}) {
+	m.PutBeanContext(context.Background(), tableName, id, obj)
+}
+
+// DelIds implements Cacher
+func (m *TxCacher) DelIds(tableName, sql string) {
+	m.DelIdsContext(context.Background(), tableName, sql)
+}
+
+// DelBean implements Cacher
+func (m *TxCacher) DelBean(tableName, id string) {
+	m.DelBeanContext(context.Background(), tableName, id)
+}
+
+// ClearIds implements Cacher
+func (m *TxCacher) ClearIds(tableName string) {
+	m.ClearIdsContext(context.Background(), tableName)
+}
+
+// ClearBeans implements Cacher
+func (m *TxCacher) ClearBeans(tableName string) {
+	m.ClearBeansContext(context.Background(), tableName)
+}
+
+// GetIdsContext implements CacherContext
+func (m *TxCacher) GetIdsContext(ctx context.Context, tableName, sql string) (interface{}, error) {
+	m.cache.mutex.Lock()
+	entry, ok := m.ids.get(tableName, sql)
+	if !ok && m.clearedDeps && !m.cache.done {
+		ok, entry.deleted = true, true
+	}
+	m.cache.mutex.Unlock()
+	if ok {
+		if entry.deleted {
+			return nil, ErrCacheMiss
+		}
+		return entry.value, nil
+	}
+
+	if mc, ok := m.cacher.(CacherContext); ok {
+		return mc.GetIdsContext(ctx, tableName, sql)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if v := m.cacher.GetIds(tableName, sql); v != nil {
+		return v, nil
+	}
+	return nil, ErrCacheMiss
+}
+
+// GetBeanContext implements CacherContext
+func (m *TxCacher) GetBeanContext(ctx context.Context, tableName, id string) (interface{}, error) {
+	m.cache.mutex.Lock()
+	entry, ok := m.beans.get(tableName, id)
+	m.cache.mutex.Unlock()
+	if ok {
+		if entry.deleted {
+			return nil, ErrCacheMiss
+		}
+		return entry.value, nil
+	}
+	return getCacheBean(ctx, m.cacher, tableName, id)
+}
+
+// PutIdsContext implements CacherContext
+func (m *TxCacher) PutIdsContext(ctx context.Context, tableName, sql string, ids interface{}) error {
+	return m.buffer(ctx, func() {
+		m.ids.set(tableName, sql, txEntry{value: ids})
+	}, func(ctx context.Context) error {
+		if mc, ok := m.cacher.(CacherContext); ok {
+			return mc.PutIdsContext(ctx, tableName, sql, ids)
+		}
+		m.cacher.PutIds(tableName, sql, ids)
+		return nil
+	})
+}
+
+// PutBeanContext implements CacherContext
+func (m *TxCacher) PutBeanContext(ctx context.Context, tableName, id string, obj interface{}) error {
+	return m.buffer(ctx, func() {
+		m.beans.set(tableName, id, txEntry{value: obj})
+	}, func(ctx context.Context) error {
+		return putCacheBean(ctx, m.cacher, tableName, id, obj)
+	})
+}
+
+// DelIdsContext implements CacherContext
+func (m *TxCacher) DelIdsContext(ctx context.Context, tableName, sql string) error {
+	return m.buffer(ctx, func() {
+		m.ids.set(tableName, sql, txEntry{deleted: true})
+	}, func(ctx context.Context) error {
+		if mc, ok := m.cacher.(CacherContext); ok {
+			return mc.DelIdsContext(ctx, tableName, sql)
+		}
+		m.cacher.DelIds(tableName, sql)
+		return nil
+	})
+}
+
+// DelBeanContext implements CacherContext
+func (m *TxCacher) DelBeanContext(ctx context.Context, tableName, id string) error {
+	return m.buffer(ctx, func() {
+		m.beans.set(tableName, id, txEntry{deleted: true})
+	}, func(ctx context.Context) error {
+		if mc, ok := m.cacher.(CacherContext); ok {
+			return mc.DelBeanContext(ctx, tableName, id)
+		}
+		m.cacher.DelBean(tableName, id)
+		return nil
+	})
+}
+
+// ClearIdsContext implements CacherContext
+func (m *TxCacher) ClearIdsContext(ctx context.Context, tableName string) error {
+	return m.buffer(ctx, func() {
+		m.ids.clear(tableName)
+		if _, ok := m.cacher.(DepsCacher); ok {
+			m.clearedDeps = true
+		}
+	}, func(ctx context.Context) error {
+		if mc, ok := m.cacher.(CacherContext); ok {
+			return mc.ClearIdsContext(ctx, tableName)
+		}
+		m.cacher.ClearIds(tableName)
+		return nil
+	})
+}
+
+// ClearBeansContext implements CacherContext
+func (m *TxCacher) ClearBeansContext(ctx context.Context, tableName string) error {
+	return m.buffer(ctx, func() {
+		m.beans.clear(tableName)
+	}, func(ctx context.Context) error {
+		if mc, ok := m.cacher.(CacherContext); ok {
+			return mc.ClearBeansContext(ctx, tableName)
+		}
+		m.cacher.ClearBeans(tableName)
+		return nil
+	})
+}
+
+// AddIdsDeps implements DepsCacher, it is a no-op when the wrapped Cacher is
+// not a DepsCacher
+func (m *TxCacher) AddIdsDeps(tableName, sql string, deps ...string) {
+	dc, ok := m.cacher.(DepsCacher)
+	if !ok {
+		return
+	}
+	m.buffer(context.Background(), func() {}, func(ctx context.Context) error {
+		dc.AddIdsDeps(tableName, sql, deps...)
+		return nil
+	})
+}
+
+// buffer records a write in the view of the Tx and queues op until the
+// commit. Once the Tx is done, op is applied at once.
+func (m *TxCacher) buffer(ctx context.Context, view func(), op func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.cache.mutex.Lock()
+	if m.cache.done {
+		m.cache.mutex.Unlock()
+		return op(ctx)
+	}
+	view()
+	m.cache.add(op)
+	m.cache.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"testing"
+)
+
+func TestTxCacher(t *testing.T) {
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+	cacher.PutBean("user", "1", 1)
+	cacher.PutBean("user", "2", 2)
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txCacher := tx.Cacher(cacher)
+	if tx.Cacher(cacher) != txCacher || tx.Cacher(txCacher) != txCacher {
+		t.Fatal("a Tx should have one TxCacher per Cacher")
+	}
+	txCacher.ClearBeans("user")
+	txCacher.PutBean("user", "3", 3)
+	if txCacher.GetBean("user", "1") != nil || txCacher.GetBean("user", "3") != 3 {
+		t.Fatal("the Tx should see its own writes")
+	}
+	if cacher.GetBean("user", "1") != 1 || cacher.GetBean("user", "3") != nil {
+		t.Fatal("the writes of the Tx should not be applied before the commit")
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if cacher.GetBean("user", "1") != 1 || cacher.GetBean("user", "3") != nil {
+		t.Fatal("the writes of the Tx should be dropped by the rollback")
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txCacher = tx.Cacher(cacher)
+	txCacher.DelBean("user", "1")
+	if err = PutCacheSql(txCacher, []PK{{2}}, "user", "select id from user", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := GetCacheSql(txCacher, "user", "select id from user", nil); err != nil || len(ids) != 1 {
+		t.Fatal("the Tx should see its own ids, got", ids, err)
+	}
+	// a reader outside of the Tx caches the data before the commit
+	cacher.PutBean("user", "1", 1)
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if cacher.GetBean("user", "1") != nil || cacher.GetBean("user", "2") != 2 {
+		t.Fatal("the deletion should be applied by the commit")
+	}
+	if ids, err := GetCacheSql(cacher, "user", "select id from user", nil); err != nil || len(ids) != 1 {
+		t.Fatal("the ids should be cached by the commit, got", ids, err)
+	}
+
+	// after the commit, the writes are applied at once
+	txCacher.DelBean("user", "2")
+	if cacher.GetBean("user", "2") != nil {
+		t.Fatal("the writes should not be buffered once the Tx is done")
+	}
+}
@@ -0,0 +1,513 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Codec serializes the values stored in caches, such as the encoded id lists
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// CodecCacher is implemented by Cachers which choose the Codec of their id lists
+type CodecCacher interface {
+	Codec() Codec
+}
+
+var (
+	// GobCodec encodes values with encoding/gob
+	GobCodec Codec = gobCodec{}
+	// JSONCodec encodes values with encoding/json, the elements of PKs are
+	// tagged with their type names so that they are decoded to the same types
+	JSONCodec Codec = jsonCodec{}
+	// BinaryCodec encodes PKs with a compact binary layout and falls back to
+	// encoding/gob for other values
+	BinaryCodec Codec = binaryCodec{}
+)
+
+// cacherCodec returns the Codec of m or GobCodec
+func cacherCodec(m Cacher) Codec {
+	if cc, ok := m.(CodecCacher); ok {
+		if c := cc.Codec(); c != nil {
+			return c
+		}
+	}
+	return GobCodec
+}
+
+var (
+	pkTypes     = make(map[string]reflect.Type)
+	pkTypeNames = make(map[reflect.Type]string)
+	pkTypeMutex sync.RWMutex
+)
+
+// RegisterPKType registers the type of value under name, so that PK elements
+// of this type could be encoded by all the codecs. The name must be the same
+// in all the processes sharing the encoded values.
+func RegisterPKType(name string, value interface{}) {
+	t := reflect.TypeOf(value)
+	pkTypeMutex.Lock()
+	defer pkTypeMutex.Unlock()
+	if _, ok := builtinPKTypes[name]; ok {
+		panic("core: RegisterPKType of builtin type name " + name)
+	}
+	gob.RegisterName(name, value)
+	pkTypes[name] = t
+	pkTypeNames[t] = name
+}
+
+var builtinPKTypes = map[string]reflect.Type{
+	"int": IntType, "int8": Int8Type, "int16": Int16Type, "int32": Int32Type, "int64": Int64Type,
+	"uint": UintType, "uint8": Uint8Type, "uint16": Uint16Type, "uint32": Uint32Type, "uint64": Uint64Type,
+	"float32": Float32Type, "float64": Float64Type, "bool": BoolType, "string": StringType,
+	"bytes": BytesType, "time": TimeType,
+}
+
+func init() {
+	// gob registers the other builtin PK element types itself
+	gob.Register(time.Time{})
+}
+
+var builtinPKTypeNames = func() map[reflect.Type]string {
+	res := make(map[reflect.Type]string, len(builtinPKTypes))
+	for name, t := range builtinPKTypes {
+		res[t] = name
+	}
+	return res
+}()
+
+// pkTypeName returns the name a PK element's type is encoded with
+func pkTypeName(t reflect.Type) (string, bool) {
+	if name, ok := builtinPKTypeNames[t]; ok {
+		return name, true
+	}
+	pkTypeMutex.RLock()
+	defer pkTypeMutex.RUnlock()
+	name, ok := pkTypeNames[t]
+	return name, ok
+}
+
+func pkType(name string) (reflect.Type, bool) {
+	if t, ok := builtinPKTypes[name]; ok {
+		return t, true
+	}
+	pkTypeMutex.RLock()
+	defer pkTypeMutex.RUnlock()
+	t, ok := pkTypes[name]
+	return t, ok
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// jsonPKElem is the JSON layout of a PK element
+type jsonPKElem struct {
+	Type  string          `json:"t,omitempty"`
+	Value json.RawMessage `json:"v,omitempty"`
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	var pks []PK
+	switch p := v.(type) {
+	case []PK:
+		pks = p
+	case *[]PK:
+		pks = *p
+	case PK:
+		return marshalJSONPK(p)
+	case *PK:
+		return marshalJSONPK(*p)
+	default:
+		return json.Marshal(v)
+	}
+
+	res := make([][]jsonPKElem, len(pks))
+	for i, pk := range pks {
+		elems, err := jsonPKElems(pk)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = elems
+	}
+	return json.Marshal(res)
+}
+
+func marshalJSONPK(pk PK) ([]byte, error) {
+	elems, err := jsonPKElems(pk)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(elems)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	switch p := v.(type) {
+	case *[]PK:
+		var elems [][]jsonPKElem
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return err
+		}
+		pks := make([]PK, len(elems))
+		for i, e := range elems {
+			pk, err := jsonPK(e)
+			if err != nil {
+				return err
+			}
+			pks[i] = pk
+		}
+		*p = pks
+		return nil
+	case *PK:
+		var elems []jsonPKElem
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return err
+		}
+		pk, err := jsonPK(elems)
+		if err != nil {
+			return err
+		}
+		*p = pk
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func jsonPKElems(pk PK) ([]jsonPKElem, error) {
+	elems := make([]jsonPKElem, len(pk))
+	for i, v := range pk {
+		if v == nil {
+			continue
+		}
+		name, ok := pkTypeName(reflect.TypeOf(v))
+		if !ok {
+			return nil, fmt.Errorf("unregistered PK element type %T", v)
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = jsonPKElem{name, data}
+	}
+	return elems, nil
+}
+
+func jsonPK(elems []jsonPKElem) (PK, error) {
+	pk := make(PK, len(elems))
+	for i, e := range elems {
+		if e.Type == "" {
+			continue
+		}
+		t, ok := pkType(e.Type)
+		if !ok {
+			return nil, fmt.Errorf("unregistered PK element type %s", e.Type)
+		}
+		v := reflect.New(t)
+		if err := json.Unmarshal(e.Value, v.Interface()); err != nil {
+			return nil, err
+		}
+		pk[i] = v.Elem().Interface()
+	}
+	return pk, nil
+}
+
+// binary layout tags of PK elements
+const (
+	binNil byte = iota
+	binInt
+	binUint
+	binFloat32
+	binFloat64
+	binBool
+	binString
+	binBytes
+	binTime
+	binRegistered
+)
+
+var errBinaryCodec = errors.New("xorm/codec: malformed binary PK")
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var pks []PK
+	switch p := v.(type) {
+	case []PK:
+		pks = p
+	case *[]PK:
+		pks = *p
+	default:
+		return GobCodec.Marshal(v)
+	}
+
+	buf := make([]byte, 0, 16*len(pks))
+	buf = binary.AppendUvarint(buf, uint64(len(pks)))
+	for _, pk := range pks {
+		buf = binary.AppendUvarint(buf, uint64(len(pk)))
+		for _, elem := range pk {
+			var err error
+			if buf, err = appendBinaryPKElem(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf, nil
+}
+
+func appendBinaryBytes(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendBinaryPKElem(buf []byte, elem interface{}) ([]byte, error) {
+	if elem == nil {
+		return append(buf, binNil), nil
+	}
+	t := reflect.TypeOf(elem)
+	name, ok := pkTypeName(t)
+	if !ok {
+		return nil, fmt.Errorf("unregistered PK element type %s", t)
+	}
+	if _, builtin := builtinPKTypes[name]; !builtin {
+		data, err := json.Marshal(elem)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, binRegistered)
+		buf = appendBinaryBytes(buf, []byte(name))
+		return appendBinaryBytes(buf, data), nil
+	}
+
+	switch v := elem.(type) {
+	case float32:
+		buf = append(buf, binFloat32)
+		return binary.BigEndian.AppendUint32(buf, math.Float32bits(v)), nil
+	case float64:
+		buf = append(buf, binFloat64)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(v)), nil
+	case bool:
+		if v {
+			return append(buf, binBool, 1), nil
+		}
+		return append(buf, binBool, 0), nil
+	case string:
+		buf = append(buf, binString)
+		return appendBinaryBytes(buf, []byte(v)), nil
+	case []byte:
+		buf = append(buf, binBytes)
+		return appendBinaryBytes(buf, v), nil
+	case time.Time:
+		data, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, binTime)
+		return appendBinaryBytes(buf, data), nil
+	}
+
+	// integers keep their type name so that they are decoded to the same type
+	rv := reflect.ValueOf(elem)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf = append(buf, binInt)
+		buf = appendBinaryBytes(buf, []byte(name))
+		return binary.AppendVarint(buf, rv.Int()), nil
+	default:
+		buf = append(buf, binUint)
+		buf = appendBinaryBytes(buf, []byte(name))
+		return binary.AppendUvarint(buf, rv.Uint()), nil
+	}
+}
+
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errBinaryCodec
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errBinaryCodec
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *binaryReader) next(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = errBinaryCodec
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) bytes() []byte {
+	return r.next(r.uvarint())
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	pks, ok := v.(*[]PK)
+	if !ok {
+		return GobCodec.Unmarshal(data, v)
+	}
+
+	r := &binaryReader{data: data}
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(data)) {
+		return errBinaryCodec
+	}
+	res := make([]PK, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		size := r.uvarint()
+		if r.err == nil && size > uint64(len(r.data)) {
+			return errBinaryCodec
+		}
+		pk := make(PK, 0, size)
+		for j := uint64(0); j < size && r.err == nil; j++ {
+			elem, err := r.pkElem()
+			if err != nil {
+				return err
+			}
+			pk = append(pk, elem)
+		}
+		res = append(res, pk)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	*pks = res
+	return nil
+}
+
+func (r *binaryReader) pkElem() (interface{}, error) {
+	tag := r.next(1)
+	if r.err != nil {
+		return nil, r.err
+	}
+	switch tag[0] {
+	case binNil:
+		return nil, nil
+	case binFloat32:
+		b := r.next(4)
+		if r.err != nil {
+			return nil, r.err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), nil
+	case binFloat64:
+		b := r.next(8)
+		if r.err != nil {
+			return nil, r.err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case binBool:
+		b := r.next(1)
+		if r.err != nil {
+			return nil, r.err
+		}
+		return b[0] == 1, nil
+	case binString:
+		return string(r.bytes()), r.err
+	case binBytes:
+		b := r.bytes()
+		return append([]byte{}, b...), r.err
+	case binTime:
+		var t time.Time
+		b := r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := t.UnmarshalBinary(b); err != nil {
+			return nil, err
+		}
+		return t, nil
+	case binInt, binUint:
+		t, ok := pkType(string(r.bytes()))
+		if r.err != nil {
+			return nil, r.err
+		}
+		if !ok {
+			return nil, errBinaryCodec
+		}
+		switch t.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if tag[0] != binInt {
+				return nil, errBinaryCodec
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if tag[0] != binUint {
+				return nil, errBinaryCodec
+			}
+		default:
+			return nil, errBinaryCodec
+		}
+		v := reflect.New(t).Elem()
+		if tag[0] == binInt {
+			v.SetInt(r.varint())
+		} else {
+			v.SetUint(r.uvarint())
+		}
+		return v.Interface(), r.err
+	case binRegistered:
+		name := string(r.bytes())
+		data := r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		t, ok := pkType(name)
+		if !ok {
+			return nil, fmt.Errorf("unregistered PK element type %s", name)
+		}
+		v := reflect.New(t)
+		if err := json.Unmarshal(data, v.Interface()); err != nil {
+			return nil, err
+		}
+		return v.Elem().Interface(), nil
+	}
+	return nil, errBinaryCodec
+}
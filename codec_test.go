@@ -0,0 +1,85 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testPKCode struct {
+	Prefix string
+	Seq    int
+}
+
+func init() {
+	RegisterPKType("core.testPKCode", testPKCode{})
+}
+
+func TestCodecs(t *testing.T) {
+	now := time.Date(2019, 6, 17, 10, 20, 30, 400, time.UTC)
+	ids := []PK{
+		{1, int8(-2), int64(3), uint(4), uint32(5), float32(6.5), 7.5, "8", []byte("9"), true, now, nil},
+		{testPKCode{"u", 10}},
+	}
+
+	for _, codec := range []Codec{GobCodec, JSONCodec, BinaryCodec} {
+		data, err := codec.Marshal(ids)
+		if err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		var res []PK
+		if err = codec.Unmarshal(data, &res); err != nil {
+			t.Fatalf("%T: %v", codec, err)
+		}
+		if !reflect.DeepEqual(res, ids) {
+			t.Errorf("%T: %#v should be equal to %#v", codec, res, ids)
+		}
+	}
+
+	type unregistered struct{ A int }
+	for _, codec := range []Codec{JSONCodec, BinaryCodec} {
+		if _, err := codec.Marshal([]PK{{unregistered{1}}}); err == nil {
+			t.Errorf("%T: unregistered PK element type should fail", codec)
+		}
+	}
+
+	malformed := [][]byte{
+		append(append([]byte{1, 1, binInt, 6}, "string"...), 2),
+		append(append([]byte{1, 1, binUint, 5}, "int64"...), 2),
+		append(append([]byte{1, 1, binInt, 6}, "uint32"...), 2),
+		{1, 1, binTime, 1, 0},
+	}
+	for _, data := range malformed {
+		var res []PK
+		if err := BinaryCodec.Unmarshal(data, &res); err == nil {
+			t.Errorf("%v should be malformed but is %#v", data, res)
+		}
+	}
+}
+
+func TestLRUCacherCodec(t *testing.T) {
+	store := NewLRUStore(0)
+	defer store.Close()
+	cacher := NewLRUCacher(store, 0)
+	cacher.SetCodec(JSONCodec)
+
+	sql := "select id from user"
+	if err := PutCacheSql(cacher, []PK{{int64(1)}}, "user", sql, nil); err != nil {
+		t.Fatal(err)
+	}
+	v, _ := store.Get(genSqlCacheKey("user", GenSqlKey(sql, nil)))
+	if v != `[[{"t":"int64","v":1}]]` {
+		t.Fatal("ids should be encoded with JSON, got", v)
+	}
+	ids, err := GetCacheSql(cacher, "user", sql, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []PK{{int64(1)}}) {
+		t.Fatal("unexpected ids", ids)
+	}
+}
@@ -9,62 +9,150 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"fmt"
+	"path"
 	"reflect"
-	"regexp"
+	"strings"
 	"sync"
 )
 
 var (
 	DefaultCacheSize = 200
+	// DefaultPlanCacheSize is the number of compiled named queries kept by a DB
+	DefaultPlanCacheSize = 500
 )
 
+// isExpandedArg reports whether v is a slice or an array, but of bytes, whose
+// elements are bound to as many placeholders
+func isExpandedArg(v interface{}) bool {
+	if _, ok := v.(driver.Valuer); ok {
+		return false
+	}
+	t := reflect.TypeOf(v)
+	if t == nil || (t.Kind() != reflect.Slice && t.Kind() != reflect.Array) {
+		return false
+	}
+	return t.Elem().Kind() != reflect.Uint8
+}
+
+// expandArg appends v, or its elements when it is expanded, to args and
+// returns the placeholders of the named parameter
+func expandArg(name string, v interface{}, args []interface{}) (string, []interface{}, error) {
+	if !isExpandedArg(v) {
+		return "?", append(args, v), nil
+	}
+	vv := reflect.ValueOf(v)
+	if vv.Len() == 0 {
+		return "?", args, fmt.Errorf("named parameter %s is an empty %s", name, vv.Type())
+	}
+	placeholders := make([]string, vv.Len())
+	for i := 0; i < vv.Len(); i++ {
+		placeholders[i] = "?"
+		args = append(args, vv.Index(i).Interface())
+	}
+	return strings.Join(placeholders, ", "), args, nil
+}
+
+// MapToSlice replaces the ?name parameters of query by the values of the map
+// mp points to, a slice or array value but []byte is expanded to "?, ?, ?"
 func MapToSlice(query string, mp interface{}) (string, []interface{}, error) {
-	vv := reflect.ValueOf(mp)
-	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Map {
-		return "", []interface{}{}, ErrNoMapPointer
-	}
-
-	args := make([]interface{}, 0, len(vv.Elem().MapKeys()))
-	var err error
-	query = re.ReplaceAllStringFunc(query, func(src string) string {
-		v := vv.Elem().MapIndex(reflect.ValueOf(src[1:]))
-		if !v.IsValid() {
-			err = fmt.Errorf("map key %s is missing", src[1:])
-		} else {
-			args = append(args, v.Interface())
+	return QuestionParam.MapToSlice(query, mp)
+}
+
+// StructToSlice replaces the ?name parameters of query by the fields of the
+// struct st points to, a slice or array field but []byte is expanded to
+// "?, ?, ?"
+func StructToSlice(query string, st interface{}) (string, []interface{}, error) {
+	return QuestionParam.StructToSlice(query, st)
+}
+
+// MapToSlice is MapToSlice for the named parameters of style s
+func (s ParamStyle) MapToSlice(query string, mp interface{}) (string, []interface{}, error) {
+	return newQueryPlan(paramBinder{style: s, lexer: defaultLexer}, query).mapToSlice(mp)
+}
+
+// StructToSlice is StructToSlice for the named parameters of style s
+func (s ParamStyle) StructToSlice(query string, st interface{}) (string, []interface{}, error) {
+	return newQueryPlan(paramBinder{style: s, lexer: defaultLexer}, query).structToSlice(st)
+}
+
+// structField returns the field of the struct v named by the parameter name:
+// a dot separated path of field names, including the promoted fields of the
+// embedded structs, or of column names, which are the names given by the
+// xorm tags such as `xorm:"'user_name'"` or the field names translated by
+// mapper. Pointers to structs are followed.
+func structField(v reflect.Value, name string, mapper IMapper) (reflect.Value, error) {
+	path, err := compileFieldPath(v.Type(), name, mapper)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return path.value(v, name)
+}
+
+// fieldIndex looks a field of t up by its name first, then by its column name
+func fieldIndex(t reflect.Type, name string, mapper IMapper) ([]int, bool) {
+	if f, ok := t.FieldByName(name); ok {
+		return f.Index, true
+	}
+
+	// breadth first like the promotion of the embedded fields
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	queue := []embedded{{t, nil}}
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		for i := 0; i < e.t.NumField(); i++ {
+			f := e.t.Field(i)
+			index := append(append([]int{}, e.index...), i)
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && ft.Kind() == reflect.Struct {
+				queue = append(queue, embedded{ft, index})
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			if strings.EqualFold(fieldColumnName(f, mapper), name) {
+				return index, true
+			}
 		}
-		return "?"
-	})
+	}
+	return nil, false
+}
 
-	return query, args, err
+// fieldColumnName returns the quoted name of the xorm tag of f or its name
+// translated by mapper
+func fieldColumnName(f reflect.StructField, mapper IMapper) string {
+	tag := f.Tag.Get("xorm")
+	if i := strings.IndexByte(tag, '\''); i >= 0 {
+		if j := strings.IndexByte(tag[i+1:], '\''); j >= 0 {
+			return tag[i+1 : i+1+j]
+		}
+	}
+	if mapper == nil {
+		return f.Name
+	}
+	return mapper.Obj2Table(f.Name)
 }
 
-func StructToSlice(query string, st interface{}) (string, []interface{}, error) {
-	vv := reflect.ValueOf(st)
-	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Struct {
-		return "", []interface{}{}, ErrNoStructPointer
-	}
-
-	args := make([]interface{}, 0)
-	var err error
-	query = re.ReplaceAllStringFunc(query, func(src string) string {
-		fv := vv.Elem().FieldByName(src[1:]).Interface()
-		if v, ok := fv.(driver.Valuer); ok {
-			var value driver.Value
-			value, err = v.Value()
-			if err != nil {
-				return "?"
+// fieldByIndex is reflect.Value.FieldByIndex without panicking on a nil
+// embedded pointer
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, fmt.Errorf("embedded %v is nil", v.Type())
 			}
-			args = append(args, value)
-		} else {
-			args = append(args, fv)
+			v = v.Elem()
 		}
-		return "?"
-	})
-	if err != nil {
-		return "", []interface{}{}, err
+		v = v.Field(x)
 	}
-	return query, args, nil
+	return v, nil
 }
 
 type cacheStruct struct {
@@ -75,7 +163,15 @@ type cacheStruct struct {
 // DB is a wrap of sql.DB with extra contents
 type DB struct {
 	*sql.DB
+	// Mapper maps the fields of the structs to columns, it is changed with
+	// SetMapper once db is used so that the compiled queries are dropped
 	Mapper            IMapper
+	paramStyle        ParamStyle
+	namedArgStyle     ParamStyle
+	dialect           Dialect
+	dbType            DbType
+	filters           []Filter
+	plans             *planCache
 	reflectCache      map[reflect.Type]*cacheStruct
 	reflectCacheMutex sync.RWMutex
 }
@@ -89,17 +185,163 @@ func Open(driverName, dataSourceName string) (*DB, error) {
 	return &DB{
 		DB:           db,
 		Mapper:       NewCacheMapper(&SnakeMapper{}),
+		dbType:       driverDBType(driverName, dataSourceName),
 		reflectCache: make(map[reflect.Type]*cacheStruct),
+		plans:        newPlanCache(DefaultPlanCacheSize),
 	}, nil
 }
 
 // FromDB creates a DB from a sql.DB
 func FromDB(db *sql.DB) *DB {
+	var dbType DbType
+	if db != nil {
+		t := reflect.TypeOf(db.Driver())
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		dbType = driverTypes[path.Base(t.PkgPath())]
+	}
 	return &DB{
 		DB:           db,
 		Mapper:       NewCacheMapper(&SnakeMapper{}),
+		dbType:       dbType,
 		reflectCache: make(map[reflect.Type]*cacheStruct),
+		plans:        newPlanCache(DefaultPlanCacheSize),
+	}
+}
+
+// driverTypes are the database types of the common drivers by name and by
+// package name
+var driverTypes = map[string]DbType{
+	"mysql":      MYSQL,
+	"mymysql":    MYSQL,
+	"godrv":      MYSQL,
+	"postgres":   POSTGRES,
+	"pgx":        POSTGRES,
+	"pq":         POSTGRES,
+	"sqlite3":    SQLITE,
+	"go-sqlite3": SQLITE,
+	"mssql":      MSSQL,
+	"sqlserver":  MSSQL,
+	"go-mssqldb": MSSQL,
+	"oci8":       ORACLE,
+	"go-oci8":    ORACLE,
+	"goracle":    ORACLE,
+}
+
+// driverDBType returns the database type of the driver, which the SQL is
+// parsed for until a dialect is bound
+func driverDBType(driverName, dataSourceName string) DbType {
+	if driver := QueryDriver(driverName); driver != nil {
+		if uri, err := driver.Parse(driverName, dataSourceName); err == nil && uri.DbType != "" {
+			return uri.DbType
+		}
+	}
+	return driverTypes[driverName]
+}
+
+// ParamStyle returns the syntax of the named parameters of db
+func (db *DB) ParamStyle() ParamStyle {
+	return db.paramStyle
+}
+
+// SetParamStyle sets the syntax of the named parameters of db, it is
+// QuestionParam by default
+func (db *DB) SetParamStyle(style ParamStyle) {
+	db.paramStyle = style
+}
+
+// NamedArgStyle returns the syntax of the named parameters the driver of db
+// binds to sql.NamedArg, 0 when it is not used
+func (db *DB) NamedArgStyle() ParamStyle {
+	return db.namedArgStyle
+}
+
+// SetNamedArgStyle tells that the driver of db binds the named parameters of
+// style to sql.NamedArg. The named parameters of the Map and Struct methods
+// are then passed to the driver as sql.NamedArg, the queries with slices to
+// expand or with names which are not valid sql.NamedArg names, such as paths,
+// being still rewritten to positional parameters. 0 disables it.
+func (db *DB) SetNamedArgStyle(style ParamStyle) {
+	db.namedArgStyle = style
+}
+
+// Dialect returns the dialect db is bound to by SetDialect
+func (db *DB) Dialect() Dialect {
+	return db.dialect
+}
+
+// SetDialect binds db to dialect: the filters of dialect are applied to the
+// SQL of all the queries, executions and prepared statements of db and its
+// Txs, and the SQL is parsed according to the dialect. The named arguments
+// of a NamedArgDialect are used, see SetNamedArgStyle.
+func (db *DB) SetDialect(dialect Dialect) {
+	db.dialect = dialect
+	db.filters = nil
+	if dialect == nil {
+		return
+	}
+	db.filters = dialect.Filters()
+	if d, ok := dialect.(NamedArgDialect); ok {
+		db.namedArgStyle = d.NamedArgStyle()
+	}
+}
+
+// filter applies the filters of the dialect of db to query
+func (db *DB) filter(query string) string {
+	for _, f := range db.filters {
+		query = f.Do(query, db.dialect, nil)
+	}
+	return query
+}
+
+// filterArgs applies the filters of the dialect of db to query and args
+func (db *DB) filterArgs(query string, args []interface{}) (string, []interface{}, error) {
+	if len(db.filters) == 0 {
+		return query, args, nil
+	}
+	return doFilters(db.filters, query, args, db.dialect, nil)
+}
+
+// lexer returns the lexer of the dialect of db, or of the type of its driver
+// when it is not bound to a dialect
+func (db *DB) lexer() sqlLexer {
+	if db.dialect == nil {
+		return lexerOfType(db.dbType)
+	}
+	return lexerOf(db.dialect)
+}
+
+func (db *DB) binder() paramBinder {
+	return paramBinder{
+		style:  db.paramStyle,
+		lexer:  db.lexer(),
+		mapper: db.Mapper,
+		native: db.namedArgStyle,
+	}
+}
+
+// SetMapper sets the Mapper of db and drops the queries compiled with the
+// previous one
+func (db *DB) SetMapper(mapper IMapper) {
+	db.Mapper = mapper
+	if db.plans != nil {
+		db.plans.reset()
+	}
+}
+
+// SetPlanCacheSize sets the number of the most recently used named queries
+// whose compiled SQL, parameters and struct fields are kept, 0 disables it.
+func (db *DB) SetPlanCacheSize(size int) {
+	db.plans.resize(size)
+}
+
+// plan returns the compiled named query
+func (db *DB) plan(query string) *queryPlan {
+	if db.plans == nil {
+		return newQueryPlan(db.binder(), query)
 	}
+	return db.plans.get(db.binder(), query)
 }
 
 func (db *DB) reflectNew(typ reflect.Type) reflect.Value {
@@ -117,6 +359,10 @@ func (db *DB) reflectNew(typ reflect.Type) reflect.Value {
 
 // QueryContext overwrites sql.DB.QueryContext
 func (db *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	query, args, err := db.filterArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := db.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		if rows != nil {
@@ -133,7 +379,7 @@ func (db *DB) Query(query string, args ...interface{}) (*Rows, error) {
 }
 
 func (db *DB) QueryMapContext(ctx context.Context, query string, mp interface{}) (*Rows, error) {
-	query, args, err := MapToSlice(query, mp)
+	query, args, err := db.plan(query).mapToSlice(mp)
 	if err != nil {
 		return nil, err
 	}
@@ -145,7 +391,7 @@ func (db *DB) QueryMap(query string, mp interface{}) (*Rows, error) {
 }
 
 func (db *DB) QueryStructContext(ctx context.Context, query string, st interface{}) (*Rows, error) {
-	query, args, err := StructToSlice(query, st)
+	query, args, err := db.plan(query).structToSlice(st)
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +415,7 @@ func (db *DB) QueryRow(query string, args ...interface{}) *Row {
 }
 
 func (db *DB) QueryRowMapContext(ctx context.Context, query string, mp interface{}) *Row {
-	query, args, err := MapToSlice(query, mp)
+	query, args, err := db.plan(query).mapToSlice(mp)
 	if err != nil {
 		return &Row{nil, err}
 	}
@@ -181,7 +427,7 @@ func (db *DB) QueryRowMap(query string, mp interface{}) *Row {
 }
 
 func (db *DB) QueryRowStructContext(ctx context.Context, query string, st interface{}) *Row {
-	query, args, err := StructToSlice(query, st)
+	query, args, err := db.plan(query).structToSlice(st)
 	if err != nil {
 		return &Row{nil, err}
 	}
@@ -192,18 +438,28 @@ func (db *DB) QueryRowStruct(query string, st interface{}) *Row {
 	return db.QueryRowStructContext(context.Background(), query, st)
 }
 
-var (
-	re = regexp.MustCompile(`[?](\w+)`)
-)
+// ExecContext overwrites sql.DB.ExecContext
+func (db *DB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	query, args, err := db.filterArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+// Exec overwrites sql.DB.Exec
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
 
 // insert into (name) values (?)
 // insert into (name) values (?name)
 func (db *DB) ExecMapContext(ctx context.Context, query string, mp interface{}) (sql.Result, error) {
-	query, args, err := MapToSlice(query, mp)
+	query, args, err := db.plan(query).mapToSlice(mp)
 	if err != nil {
 		return nil, err
 	}
-	return db.DB.ExecContext(ctx, query, args...)
+	return db.ExecContext(ctx, query, args...)
 }
 
 func (db *DB) ExecMap(query string, mp interface{}) (sql.Result, error) {
@@ -211,11 +467,11 @@ func (db *DB) ExecMap(query string, mp interface{}) (sql.Result, error) {
 }
 
 func (db *DB) ExecStructContext(ctx context.Context, query string, st interface{}) (sql.Result, error) {
-	query, args, err := StructToSlice(query, st)
+	query, args, err := db.plan(query).structToSlice(st)
 	if err != nil {
 		return nil, err
 	}
-	return db.DB.ExecContext(ctx, query, args...)
+	return db.ExecContext(ctx, query, args...)
 }
 
 func (db *DB) ExecStruct(query string, st interface{}) (sql.Result, error) {
@@ -5,9 +5,11 @@
 package core
 
 import (
+	"database/sql"
 	"errors"
 	"flag"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -30,7 +32,7 @@ type User struct {
 	Created  NullTime
 }
 
-func init() {
+func TestMain(m *testing.M) {
 	flag.Parse()
 	switch *dbtype {
 	case "sqlite3":
@@ -42,23 +44,37 @@ func init() {
 	default:
 		panic("no db type")
 	}
+	os.Exit(m.Run())
 }
 
-func testOpen() (*DB, error) {
+// testOpen opens the test database, the test is skipped when it cannot be
+// reached
+func testOpen(tb testing.TB) (*DB, error) {
+	var db *DB
+	var err error
 	switch *dbtype {
 	case "sqlite3":
 		os.Remove("./test.db")
-		return Open("sqlite3", "./test.db")
+		db, err = Open("sqlite3", "./test.db")
 	case "mysql":
-		return Open("mysql", "root:@/core_test?charset=utf8")
+		db, err = Open("mysql", "root:@/core_test?charset=utf8")
 	default:
 		panic("no db type")
 	}
+	if err == nil {
+		if err = db.Ping(); err != nil {
+			db.Close()
+		}
+	}
+	if err != nil {
+		tb.Skip("no test database: ", err)
+	}
+	return db, nil
 }
 
 func BenchmarkOriQuery(b *testing.B) {
 	b.StopTimer()
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -103,7 +119,7 @@ func BenchmarkOriQuery(b *testing.B) {
 func BenchmarkStructQuery(b *testing.B) {
 	b.StopTimer()
 
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -148,7 +164,7 @@ func BenchmarkStructQuery(b *testing.B) {
 func BenchmarkStruct2Query(b *testing.B) {
 	b.StopTimer()
 
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -194,7 +210,7 @@ func BenchmarkStruct2Query(b *testing.B) {
 func BenchmarkSliceInterfaceQuery(b *testing.B) {
 	b.StopTimer()
 
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -303,7 +319,7 @@ func BenchmarkSliceInterfaceQuery(b *testing.B) {
 
 func BenchmarkSliceStringQuery(b *testing.B) {
 	b.StopTimer()
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -354,7 +370,7 @@ func BenchmarkSliceStringQuery(b *testing.B) {
 func BenchmarkMapInterfaceQuery(b *testing.B) {
 	b.StopTimer()
 
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -501,7 +517,7 @@ func BenchmarkMapStringQuery(b *testing.B) {
 func BenchmarkExec(b *testing.B) {
 	b.StopTimer()
 
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -526,7 +542,7 @@ func BenchmarkExec(b *testing.B) {
 func BenchmarkExecMap(b *testing.B) {
 	b.StopTimer()
 
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -559,7 +575,7 @@ func BenchmarkExecMap(b *testing.B) {
 }
 
 func TestExecMap(t *testing.T) {
-	db, err := testOpen()
+	db, err := testOpen(t)
 	if err != nil {
 		t.Error(err)
 	}
@@ -602,7 +618,7 @@ func TestExecMap(t *testing.T) {
 }
 
 func TestExecStruct(t *testing.T) {
-	db, err := testOpen()
+	db, err := testOpen(t)
 	if err != nil {
 		t.Error(err)
 	}
@@ -643,9 +659,168 @@ func TestExecStruct(t *testing.T) {
 	}
 }
 
+func TestExpandSliceArgs(t *testing.T) {
+	mp := map[string]interface{}{
+		"ids":  []int64{1, 2, 3},
+		"data": []byte("xlw"),
+		"name": "xlw",
+	}
+	query, args, err := MapToSlice("select * from user where id in (?ids) and name = ?name and data = ?data", &mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "select * from user where id in (?, ?, ?) and name = ? and data = ?" || len(args) != 5 {
+		t.Fatal("unexpected query", query, args)
+	}
+	if args[0] != int64(1) || args[2] != int64(3) || args[3] != "xlw" {
+		t.Fatal("unexpected args", args)
+	}
+
+	mp["ids"] = []int64{}
+	if _, _, err = MapToSlice("select * from user where id in (?ids)", &mp); err == nil {
+		t.Fatal("an empty slice should be an error")
+	}
+
+	st := struct {
+		Names [2]string
+		Data  []byte
+	}{[2]string{"a", "b"}, []byte("xlw")}
+	query, args, err = StructToSlice("select * from user where name in (?Names) and data = ?Data", &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "select * from user where name in (?, ?) and data = ?" || len(args) != 3 || args[1] != "b" {
+		t.Fatal("unexpected query", query, args)
+	}
+}
+
+func TestStructToSliceFields(t *testing.T) {
+	type Author struct {
+		Name string
+	}
+	type Base struct {
+		Id int64
+	}
+	type Post struct {
+		Base
+		Title    string `xorm:"'post_title' notnull"`
+		ViewNum  int
+		Author   *Author
+		Reviewer *Author
+	}
+	post := Post{Base{1}, "xorm", 2, &Author{"xlw"}, nil}
+
+	query, args, err := newQueryPlan(paramBinder{style: QuestionParam, lexer: defaultLexer, mapper: SnakeMapper{}}, "?Id ?id ?post_title ?view_num ?Author.Name ?author.name.").structToSlice(&post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "? ? ? ? ? ?." || !reflect.DeepEqual(args, []interface{}{int64(1), int64(1), "xorm", 2, "xlw", "xlw"}) {
+		t.Fatal("unexpected query", query, args)
+	}
+
+	if _, _, err = StructToSlice("?Missing", &post); err == nil {
+		t.Fatal("a missing field should be an error")
+	}
+	if _, _, err = StructToSlice("?Reviewer.Name", &post); err == nil {
+		t.Fatal("a nil pointer in a path should be an error")
+	}
+	if _, _, err = StructToSlice("?Title.Name", &post); err == nil {
+		t.Fatal("a path through a non struct should be an error")
+	}
+}
+
+func TestQueryMapIn(t *testing.T) {
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(createTableSql); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err = db.Exec("insert into user (`name`) values (?)", "xlw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mp := map[string]interface{}{"ids": []int64{2, 4}}
+	rows, err := db.QueryMap("select id from user where id in (?ids) order by id", &mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 4 {
+		t.Fatal("unexpected ids", ids)
+	}
+
+	stmt, err := db.Prepare("select id from user where id in (?ids)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if _, err = stmt.QueryMap(&mp); err == nil {
+		t.Fatal("a slice should be an error for a prepared statement")
+	}
+}
+
+func TestStmtRepeatedNames(t *testing.T) {
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err = db.Exec(createTableSql); err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := db.Prepare("insert into user (`name`, title, alias, nick_name) values (?name, ?title, ?name, ?title)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := map[string]interface{}{"name": "xlw", "title": "tester"}
+	if _, err = stmt.ExecMap(&mp); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	stmt, err = tx.Prepare("select count(*) from user where alias = ?Name and `name` = ?Name and nick_name = ?Title and title = ?Title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	user := User{Name: "xlw", Title: "tester"}
+	var count int
+	if err = stmt.QueryRowStruct(&user).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("the inserted user should be found, got", count)
+	}
+
+	if err = stmt.QueryRowMap(&map[string]interface{}{"Name": "xlw"}).Scan(&count); err == nil {
+		t.Fatal("a missing map key should be an error")
+	}
+}
+
 func BenchmarkExecStruct(b *testing.B) {
 	b.StopTimer()
-	db, err := testOpen()
+	db, err := testOpen(b)
 	if err != nil {
 		b.Error(err)
 	}
@@ -675,3 +850,233 @@ func BenchmarkExecStruct(b *testing.B) {
 		}
 	}
 }
+
+func TestDriverLexer(t *testing.T) {
+	mysql, err := Open("mysql", "root:@/core_test?charset=utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mysql.Close()
+	sqlite, err := Open("sqlite3", "./test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+
+	mp := map[string]interface{}{"id": 1, "x": 2}
+	cases := []struct {
+		db    *DB
+		query string
+		res   string
+	}{
+		{mysql, `select * from t where note = 'it\'s ?x' and id = ?id`, `select * from t where note = 'it\'s ?x' and id = ?`},
+		{FromDB(mysql.DB), `select * from t where note = 'it\'s ?x' and id = ?id`, `select * from t where note = 'it\'s ?x' and id = ?`},
+		{sqlite, `select * from t where p = 'C:\' and id = ?id`, `select * from t where p = 'C:\' and id = ?`},
+		{FromDB(sqlite.DB), `select * from t where p = 'C:\' and id = ?id`, `select * from t where p = 'C:\' and id = ?`},
+	}
+	for _, c := range cases {
+		query, args, err := c.db.plan(c.query).mapToSlice(&mp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != c.res || !reflect.DeepEqual(args, []interface{}{1}) {
+			t.Error("unexpected", query, args, "for", c.query)
+		}
+	}
+}
+
+func TestNamedArgs(t *testing.T) {
+	if *dbtype != "sqlite3" {
+		t.Skip("the driver does not bind sql.NamedArg")
+	}
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetNamedArgStyle(ColonParam)
+
+	if _, err = db.Exec(createTableSql); err != nil {
+		t.Fatal(err)
+	}
+
+	query := "insert into user (`name`, title, alias, nick_name) values (?name, ?title, ?name, ?title)"
+	mp := map[string]interface{}{"name": "named", "title": "tester"}
+	res, args, err := db.plan(query).mapToSlice(&mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "insert into user (`name`, title, alias, nick_name) values (:name, :title, :name, :title)" ||
+		!reflect.DeepEqual(args, []interface{}{sql.Named("name", "named"), sql.Named("title", "tester")}) {
+		t.Fatal("unexpected", res, args)
+	}
+	if _, err = db.ExecMap(query, &mp); err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := db.Prepare("select count(*) from user where alias = ?Name and `name` = ?Name and nick_name = ?Title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var count int
+	if err = stmt.QueryRowStruct(&User{Name: "named", Title: "tester"}).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("the inserted user should be found, got", count)
+	}
+
+	// slices and paths are still rewritten to positional parameters
+	res, args, err = db.plan("select count(*) from user where `name` in (?names)").mapToSlice(&map[string]interface{}{"names": []string{"named", "other"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != "select count(*) from user where `name` in (?, ?)" || len(args) != 2 {
+		t.Fatal("unexpected", res, args)
+	}
+	if err = db.QueryRowMap("select count(*) from user where `name` in (?names)", &map[string]interface{}{"names": []string{"named", "other"}}).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("the inserted user should be found, got", count)
+	}
+	if db.plan("select ?User.Name").native != "" {
+		t.Fatal("a path cannot be a sql.NamedArg")
+	}
+}
+
+type recordFilter struct {
+	queries []string
+}
+
+func (f *recordFilter) Do(sql string, dialect Dialect, table *Table) string {
+	f.queries = append(f.queries, sql)
+	return sql
+}
+
+type seqDialect struct {
+	filterDialect
+	record *recordFilter
+}
+
+func (d seqDialect) Filters() []Filter {
+	return []Filter{&QuoteFilter{}, &SeqFilter{Prefix: "$", Start: 1}, d.record}
+}
+
+func TestDialectFilters(t *testing.T) {
+	if *dbtype != "sqlite3" {
+		t.Skip("$1 parameters are specific to sqlite3 among the tested drivers")
+	}
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	record := &recordFilter{}
+	db.SetDialect(seqDialect{filterDialect{dbType: SQLITE}, record})
+	if db.Dialect() == nil {
+		t.Fatal("db should be bound to the dialect")
+	}
+
+	if _, err = db.Exec(createTableSql); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.ExecMap("insert into user (`name`, title) values (?name, ?title)",
+		&map[string]interface{}{"name": "filtered", "title": "tester"}); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err = db.QueryRow("select count(*) from user where `name` = ? and title = ?", "filtered", "tester").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("the inserted user should be found, got", count)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err = tx.ExecStruct("update user set title = ?Title where `name` = ?Name", &User{Name: "filtered", Title: "admin"}); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.Prepare("select count(*) from user where `name` = ?Name and title = ?Title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if err = stmt.QueryRowStruct(&User{Name: "filtered", Title: "admin"}).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("the updated user should be found, got", count)
+	}
+
+	expected := []string{
+		`insert into user ("name", title) values ($1, $2)`,
+		`select count(*) from user where "name" = $1 and title = $2`,
+		`update user set title = $1 where "name" = $2`,
+		`select count(*) from user where "name" = $1 and title = $2`,
+	}
+	if !reflect.DeepEqual(record.queries[1:], expected) {
+		t.Fatal("unexpected filtered queries", record.queries)
+	}
+}
+
+type recordArgFilter struct {
+	args [][]interface{}
+}
+
+func (f *recordArgFilter) Do(sql string, dialect Dialect, table *Table) string {
+	return sql
+}
+
+func (f *recordArgFilter) DoArgs(sql string, args []interface{}, dialect Dialect, table *Table) (string, []interface{}, error) {
+	f.args = append(f.args, args)
+	return sql, args, nil
+}
+
+type boolDialect struct {
+	filterDialect
+	record *recordArgFilter
+}
+
+func (d boolDialect) Filters() []Filter {
+	return []Filter{&BoolFilter{}, d.record}
+}
+
+func TestArgFilters(t *testing.T) {
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	record := &recordArgFilter{}
+	db.SetDialect(boolDialect{filterDialect{dbType: SQLITE}, record})
+
+	if _, err = db.Exec(createTableSql); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("insert into user (`name`, age) values (?, ?)", "bool", true); err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := db.Prepare("select count(*) from user where `name` = ?name and age = ?age")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	var count int
+	if err = stmt.QueryRowMap(&map[string]interface{}{"name": "bool", "age": true}).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatal("the inserted user should be found, got", count)
+	}
+
+	expected := [][]interface{}{nil, {"bool", 1}, {"bool", 1}}
+	if !reflect.DeepEqual(record.args, expected) {
+		t.Fatal("unexpected filtered args", record.args)
+	}
+}
@@ -81,8 +81,22 @@ type Dialect interface {
 	SetParams(params map[string]string)
 }
 
+// NamedArgDialect is implemented by the dialects whose drivers bind the
+// named parameters of a style to sql.NamedArg, see DB.SetNamedArgStyle
+type NamedArgDialect interface {
+	Dialect
+	NamedArgStyle() ParamStyle
+}
+
 func OpenDialect(dialect Dialect) (*DB, error) {
-	return Open(dialect.DriverName(), dialect.DataSourceName())
+	db, err := Open(dialect.DriverName(), dialect.DataSourceName())
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := dialect.(NamedArgDialect); ok {
+		db.SetNamedArgStyle(d.NamedArgStyle())
+	}
+	return db, nil
 }
 
 type Base struct {
@@ -5,7 +5,8 @@
 package core
 
 import (
-	"fmt"
+	"database/sql"
+	"strconv"
 	"strings"
 )
 
@@ -14,12 +15,49 @@ type Filter interface {
 	Do(sql string, dialect Dialect, table *Table) string
 }
 
+// ArgFilter is a Filter which filters the arguments of the SQL with it. Do
+// is still used when there are no arguments yet, such as when a statement is
+// prepared, and DoArgs must then return the same SQL for its arguments.
+type ArgFilter interface {
+	Filter
+	DoArgs(sql string, args []interface{}, dialect Dialect, table *Table) (string, []interface{}, error)
+}
+
+// doFilters applies filters in order to sql and args, the Filters which are
+// not ArgFilters only to sql
+func doFilters(filters []Filter, sql string, args []interface{}, dialect Dialect, table *Table) (string, []interface{}, error) {
+	for _, f := range filters {
+		af, ok := f.(ArgFilter)
+		if !ok {
+			sql = f.Do(sql, dialect, table)
+			continue
+		}
+		var err error
+		if sql, args, err = af.DoArgs(sql, args, dialect, table); err != nil {
+			return "", nil, err
+		}
+	}
+	return sql, args, nil
+}
+
 // QuoteFilter filter SQL replace ` to database's own quote character
 type QuoteFilter struct {
 }
 
 func (s *QuoteFilter) Do(sql string, dialect Dialect, table *Table) string {
-	return strings.Replace(sql, "`", dialect.QuoteStr(), -1)
+	if strings.IndexByte(sql, '`') < 0 {
+		return sql
+	}
+	return lexerOf(dialect).rewrite(sql, nil, func(quoted string) string {
+		if quoted[0] != '`' {
+			return quoted
+		}
+		return strings.Replace(quoted, "`", dialect.QuoteStr(), -1)
+	})
+}
+
+func (s *QuoteFilter) DoArgs(sql string, args []interface{}, dialect Dialect, table *Table) (string, []interface{}, error) {
+	return s.Do(sql, dialect, table), args, nil
 }
 
 // IdFilter filter SQL replace (id) to primary key column name
@@ -39,30 +77,104 @@ func (q *Quoter) Quote(content string) string {
 }
 
 func (i *IdFilter) Do(sql string, dialect Dialect, table *Table) string {
-	quoter := NewQuoter(dialect)
-	if table != nil && len(table.PrimaryKeys) == 1 {
-		sql = strings.Replace(sql, " `(id)` ", " "+quoter.Quote(table.PrimaryKeys[0])+" ", -1)
-		sql = strings.Replace(sql, " "+quoter.Quote("(id)")+" ", " "+quoter.Quote(table.PrimaryKeys[0])+" ", -1)
-		return strings.Replace(sql, " (id) ", " "+quoter.Quote(table.PrimaryKeys[0])+" ", -1)
+	if table == nil || len(table.PrimaryKeys) != 1 || !strings.Contains(sql, "(id)") {
+		return sql
 	}
-	return sql
+	quoter := NewQuoter(dialect)
+	pk := quoter.Quote(table.PrimaryKeys[0])
+	return lexerOf(dialect).rewrite(sql, func(code string) string {
+		return strings.Replace(code, " (id) ", " "+pk+" ", -1)
+	}, func(quoted string) string {
+		if quoted == "`(id)`" || quoted == quoter.Quote("(id)") {
+			return pk
+		}
+		return quoted
+	})
+}
+
+func (i *IdFilter) DoArgs(sql string, args []interface{}, dialect Dialect, table *Table) (string, []interface{}, error) {
+	return i.Do(sql, dialect, table), args, nil
 }
 
 // SeqFilter filter SQL replace ?, ? ... to $1, $2 ...
+// The ?| and ?& operators of PostgreSQL are not placeholders, unlike the ? of
+// ? || and ? &&.
 type SeqFilter struct {
 	Prefix string
 	Start  int
 }
 
 func (s *SeqFilter) Do(sql string, dialect Dialect, table *Table) string {
-	segs := strings.Split(sql, "?")
-	size := len(segs)
-	res := ""
-	for i, c := range segs {
-		if i < size-1 {
-			res += c + fmt.Sprintf("%s%v", s.Prefix, i+s.Start)
+	if strings.IndexByte(sql, '?') < 0 {
+		return sql
+	}
+	postgres := dialect != nil && dialect.DBType() == POSTGRES
+	n := s.Start
+	return lexerOf(dialect).rewrite(sql, func(code string) string {
+		var buf strings.Builder
+		for i := 0; i < len(code); i++ {
+			c := code[i]
+			if c != '?' {
+				buf.WriteByte(c)
+				continue
+			}
+			if postgres && i+1 < len(code) && (code[i+1] == '|' || code[i+1] == '&') &&
+				(i+2 == len(code) || code[i+2] != code[i+1]) {
+				buf.WriteString(code[i : i+2])
+				i++
+				continue
+			}
+			buf.WriteString(s.Prefix)
+			buf.WriteString(strconv.Itoa(n))
+			n++
+		}
+		return buf.String()
+	}, nil)
+}
+
+func (s *SeqFilter) DoArgs(sql string, args []interface{}, dialect Dialect, table *Table) (string, []interface{}, error) {
+	return s.Do(sql, dialect, table), args, nil
+}
+
+// BoolFilter filter args replace bool to 1 and 0, for the databases without
+// a boolean type
+type BoolFilter struct {
+}
+
+func (b *BoolFilter) Do(sql string, dialect Dialect, table *Table) string {
+	return sql
+}
+
+func (b *BoolFilter) DoArgs(sql string, args []interface{}, dialect Dialect, table *Table) (string, []interface{}, error) {
+	var res []interface{}
+	for i, arg := range args {
+		v, ok := boolArg(arg)
+		if !ok {
+			continue
+		}
+		if res == nil {
+			res = append([]interface{}{}, args...)
+		}
+		res[i] = v
+	}
+	if res == nil {
+		return sql, args, nil
+	}
+	return sql, res, nil
+}
+
+// boolArg returns 1 or 0 for a bool arg, ok is false for other args
+func boolArg(arg interface{}) (v interface{}, ok bool) {
+	switch arg := arg.(type) {
+	case bool:
+		if arg {
+			return 1, true
+		}
+		return 0, true
+	case sql.NamedArg:
+		if arg.Value, ok = boolArg(arg.Value); ok {
+			return arg, true
 		}
 	}
-	res += segs[size-1]
-	return res
+	return nil, false
 }
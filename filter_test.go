@@ -0,0 +1,88 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+)
+
+type filterDialect struct {
+	Dialect
+	dbType DbType
+}
+
+func (d filterDialect) DBType() DbType { return d.dbType }
+func (filterDialect) QuoteStr() string { return `"` }
+
+func TestQuoteFilter(t *testing.T) {
+	sql := (&QuoteFilter{}).Do("select `id` from `user` where name = 'a`b' -- `c`", filterDialect{dbType: POSTGRES}, nil)
+	if sql != `select "id" from "user" where name = 'a`+"`"+`b' -- `+"`c`" {
+		t.Fatal("unexpected filtered SQL", sql)
+	}
+}
+
+func TestIdFilter(t *testing.T) {
+	table := NewEmptyTable()
+	table.PrimaryKeys = []string{"uid"}
+	sql := (&IdFilter{}).Do("select * from t where (id) = ? or `(id)` = ? or \"(id)\" = ? or name = ' (id) '",
+		filterDialect{dbType: POSTGRES}, table)
+	if sql != `select * from t where "uid" = ? or "uid" = ? or "uid" = ? or name = ' (id) '` {
+		t.Fatal("unexpected filtered SQL", sql)
+	}
+}
+
+func TestSeqFilter(t *testing.T) {
+	f := &SeqFilter{Prefix: "$", Start: 1}
+	sql := f.Do("select '?', \"?\", $$ ? $$ from t where a = ? and b ?| c and d ?& e and f = ? -- ?", filterDialect{dbType: POSTGRES}, nil)
+	if sql != "select '?', \"?\", $$ ? $$ from t where a = $1 and b ?| c and d ?& e and f = $2 -- ?" {
+		t.Fatal("unexpected filtered SQL", sql)
+	}
+
+	sql = f.Do("select * from t where a like ?||'%' and b && ?&&c", filterDialect{dbType: POSTGRES}, nil)
+	if sql != "select * from t where a like $1||'%' and b && $2&&c" {
+		t.Fatal("unexpected filtered SQL", sql)
+	}
+
+	f = &SeqFilter{Prefix: ":", Start: 1}
+	sql = f.Do("insert into t values (?, ?, 'it''s ?')", filterDialect{dbType: ORACLE}, nil)
+	if sql != "insert into t values (:1, :2, 'it''s ?')" {
+		t.Fatal("unexpected filtered SQL", sql)
+	}
+	sql = f.Do("select * from t where a like ?||'%' and b = ?|c", filterDialect{dbType: ORACLE}, nil)
+	if sql != "select * from t where a like :1||'%' and b = :2|c" {
+		t.Fatal("unexpected filtered SQL", sql)
+	}
+}
+
+func TestBoolFilter(t *testing.T) {
+	args := []interface{}{true, []byte("a"), false, sql.Named("b", true), 2}
+	query, res, err := (&BoolFilter{}).DoArgs("select ?", args, filterDialect{dbType: SQLITE}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "select ?" || !reflect.DeepEqual(res, []interface{}{1, []byte("a"), 0, sql.Named("b", 1), 2}) {
+		t.Fatal("unexpected", query, res)
+	}
+	if args[0] != true {
+		t.Fatal("the args should not be modified")
+	}
+}
+
+func TestDoFilters(t *testing.T) {
+	filters := []Filter{&QuoteFilter{}, &SeqFilter{Prefix: "$", Start: 1}, &BoolFilter{}, &recordFilter{}}
+	query, args, err := doFilters(filters, "select `a` from t where b = ? and c = ?", []interface{}{true, "c"},
+		filterDialect{dbType: POSTGRES}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != `select "a" from t where b = $1 and c = $2` || !reflect.DeepEqual(args, []interface{}{1, "c"}) {
+		t.Fatal("unexpected", query, args)
+	}
+	if queries := filters[3].(*recordFilter).queries; len(queries) != 1 || queries[0] != query {
+		t.Fatal("the Filter should be applied to the SQL", queries)
+	}
+}
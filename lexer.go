@@ -0,0 +1,192 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"strings"
+)
+
+type sqlSegmentKind int
+
+const (
+	// sqlCode is the SQL outside of the other segments
+	sqlCode sqlSegmentKind = iota
+	// sqlString is a string literal with its quotes
+	sqlString
+	// sqlIdent is a quoted identifier with its quotes
+	sqlIdent
+	// sqlComment is a line comment, without its end of line, or a block comment
+	sqlComment
+	// sqlDollar is a PostgreSQL dollar quoted string such as $tag$...$tag$
+	sqlDollar
+)
+
+type sqlSegment struct {
+	kind sqlSegmentKind
+	text string
+}
+
+// sqlLexer splits SQL into code, string literals, quoted identifiers and
+// comments so that the code can be rewritten without touching the others
+type sqlLexer struct {
+	// backslashes escape the quotes of string literals, as in MySQL
+	backslash bool
+	// $tag$...$tag$ strings, as in PostgreSQL
+	dollar bool
+	// # line comments, as in MySQL
+	hash bool
+	// [name] identifiers, as in SQL Server
+	brackets bool
+}
+
+// defaultLexer is used when the dialect is unknown, backslashes only escape
+// quotes in MySQL
+var defaultLexer = sqlLexer{dollar: true}
+
+// lexerOf returns the lexer of the SQL of dialect
+func lexerOf(dialect Dialect) sqlLexer {
+	if dialect == nil {
+		return defaultLexer
+	}
+	return lexerOfType(dialect.DBType())
+}
+
+// lexerOfType returns the lexer of the SQL of the databases of type t
+func lexerOfType(t DbType) sqlLexer {
+	switch t {
+	case MYSQL:
+		return sqlLexer{backslash: true, hash: true}
+	case POSTGRES:
+		return sqlLexer{dollar: true}
+	case MSSQL:
+		return sqlLexer{brackets: true}
+	case SQLITE, ORACLE:
+		return sqlLexer{}
+	}
+	return defaultLexer
+}
+
+// split returns the segments of sql, whose texts joined are sql. An
+// unterminated string, identifier or comment lasts until the end.
+func (l sqlLexer) split(sql string) []sqlSegment {
+	var segs []sqlSegment
+	code := 0
+	flush := func(i int) {
+		if i > code {
+			segs = append(segs, sqlSegment{sqlCode, sql[code:i]})
+		}
+	}
+
+	for i := 0; i < len(sql); {
+		kind, end := l.special(sql, i)
+		if end <= i {
+			i++
+			continue
+		}
+		flush(i)
+		segs = append(segs, sqlSegment{kind, sql[i:end]})
+		i = end
+		code = end
+	}
+	flush(len(sql))
+	return segs
+}
+
+// special returns the segment starting at i and its end, or an end of 0
+// when i is in code
+func (l sqlLexer) special(sql string, i int) (sqlSegmentKind, int) {
+	c := sql[i]
+	switch {
+	case c == '\'':
+		// E'...' strings of PostgreSQL always have backslash escapes
+		escapes := l.backslash || (l.dollar && i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') &&
+			(i == 1 || !isParamChar(sql[i-2])))
+		return sqlString, quotedEnd(sql, i, '\'', escapes)
+	case c == '"':
+		return sqlIdent, quotedEnd(sql, i, '"', false)
+	case c == '`':
+		return sqlIdent, quotedEnd(sql, i, '`', false)
+	case c == '[' && l.brackets:
+		if j := strings.IndexByte(sql[i+1:], ']'); j >= 0 {
+			return sqlIdent, i + j + 2
+		}
+		return sqlIdent, len(sql)
+	case c == '-' && strings.HasPrefix(sql[i:], "--"), c == '#' && l.hash:
+		if j := strings.IndexByte(sql[i:], '\n'); j >= 0 {
+			return sqlComment, i + j
+		}
+		return sqlComment, len(sql)
+	case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+		if j := strings.Index(sql[i+2:], "*/"); j >= 0 {
+			return sqlComment, i + j + 4
+		}
+		return sqlComment, len(sql)
+	case c == '$' && l.dollar && (i == 0 || !isParamChar(sql[i-1])):
+		return sqlDollar, dollarEnd(sql, i)
+	}
+	return sqlCode, 0
+}
+
+// quotedEnd returns the end of the quoted text starting at i, a doubled quote
+// being an escaped one
+func quotedEnd(sql string, i int, quote byte, backslash bool) int {
+	for j := i + 1; j < len(sql); j++ {
+		switch sql[j] {
+		case '\\':
+			if backslash {
+				j++
+			}
+		case quote:
+			if j+1 < len(sql) && sql[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(sql)
+}
+
+// dollarEnd returns the end of the dollar quoted string starting at i, or 0
+// when there is none, such as for a $1 placeholder
+func dollarEnd(sql string, i int) int {
+	j := i + 1
+	if j < len(sql) && sql[j] != '$' {
+		if c := sql[j]; !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80) {
+			return 0
+		}
+		for j < len(sql) && (isParamChar(sql[j]) || sql[j] >= 0x80) {
+			j++
+		}
+	}
+	if j >= len(sql) || sql[j] != '$' {
+		return 0
+	}
+	tag := sql[i : j+1]
+	k := strings.Index(sql[j+1:], tag)
+	if k < 0 {
+		return 0
+	}
+	return j + 1 + k + len(tag)
+}
+
+// rewrite returns sql with its code segments replaced by fn, and its quoted
+// identifiers by ident when not nil
+func (l sqlLexer) rewrite(sql string, fn func(code string) string, ident func(quoted string) string) string {
+	segs := l.split(sql)
+	var buf strings.Builder
+	buf.Grow(len(sql))
+	for _, seg := range segs {
+		switch {
+		case seg.kind == sqlCode && fn != nil:
+			buf.WriteString(fn(seg.text))
+		case seg.kind == sqlIdent && ident != nil:
+			buf.WriteString(ident(seg.text))
+		default:
+			buf.WriteString(seg.text)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"testing"
+)
+
+func TestLexerSplit(t *testing.T) {
+	cases := []struct {
+		lexer sqlLexer
+		sql   string
+		kinds []sqlSegmentKind
+	}{
+		{defaultLexer, "select 1", []sqlSegmentKind{sqlCode}},
+		{defaultLexer, "a = 'it''s ?' and b = ?", []sqlSegmentKind{sqlCode, sqlString, sqlCode}},
+		{sqlLexer{backslash: true}, `a = 'x\' ?' and "c?" = ?`, []sqlSegmentKind{sqlCode, sqlString, sqlCode, sqlIdent, sqlCode}},
+		{sqlLexer{}, `a = 'x\' ?'`, []sqlSegmentKind{sqlCode, sqlString, sqlCode, sqlString}},
+		{defaultLexer, `a = 'C:\' and b = ?`, []sqlSegmentKind{sqlCode, sqlString, sqlCode}},
+		{defaultLexer, "a -- ?\nb /* ? */ c", []sqlSegmentKind{sqlCode, sqlComment, sqlCode, sqlComment, sqlCode}},
+		{sqlLexer{hash: true}, "a # ?\nb", []sqlSegmentKind{sqlCode, sqlComment, sqlCode}},
+		{defaultLexer, "a # ?", []sqlSegmentKind{sqlCode}},
+		{sqlLexer{brackets: true}, "[a?] = ?", []sqlSegmentKind{sqlIdent, sqlCode}},
+		{defaultLexer, "$$ ? $$, $f$ '?' $f$, $1", []sqlSegmentKind{sqlDollar, sqlCode, sqlDollar, sqlCode}},
+		{defaultLexer, "a$b$ = ?$b$", []sqlSegmentKind{sqlCode}},
+		{defaultLexer, "E'\\' ?' = ?", []sqlSegmentKind{sqlCode, sqlString, sqlCode}},
+		{defaultLexer, "'unterminated ?", []sqlSegmentKind{sqlString}},
+	}
+
+	for _, c := range cases {
+		segs := c.lexer.split(c.sql)
+		var joined string
+		var kinds []sqlSegmentKind
+		for _, seg := range segs {
+			joined += seg.text
+			kinds = append(kinds, seg.kind)
+		}
+		if joined != c.sql {
+			t.Errorf("%q: segments join to %q", c.sql, joined)
+		}
+		if len(kinds) != len(c.kinds) {
+			t.Errorf("%q: expected kinds %v but got %v", c.sql, c.kinds, kinds)
+			continue
+		}
+		for i := range kinds {
+			if kinds[i] != c.kinds[i] {
+				t.Errorf("%q: expected kinds %v but got %v", c.sql, c.kinds, kinds)
+				break
+			}
+		}
+	}
+}
+
+func TestParamsInLiterals(t *testing.T) {
+	query, args, err := MapToSlice("select '?id', `?id` -- ?id\nwhere id = ?id /* ?id */", &map[string]interface{}{"id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "select '?id', `?id` -- ?id\nwhere id = ? /* ?id */" || len(args) != 1 {
+		t.Fatal("unexpected rewrite", query, args)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"strings"
+)
+
+// ParamStyle is the syntax of the named parameters of the queries given to
+// MapToSlice, StructToSlice and the Map and Struct methods of DB, Tx and Stmt
+type ParamStyle byte
+
+const (
+	// QuestionParam is the default ?name style
+	QuestionParam ParamStyle = '?'
+	// ColonParam is the :name style, a :: cast is not a parameter
+	ColonParam ParamStyle = ':'
+	// AtParam is the @name style, a @@variable is not a parameter
+	AtParam ParamStyle = '@'
+	// DollarParam is the $name style, a positional $1 is not a parameter
+	DollarParam ParamStyle = '$'
+)
+
+func (s ParamStyle) prefix() byte {
+	if s == 0 {
+		return byte(QuestionParam)
+	}
+	return byte(s)
+}
+
+func isParamChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// paramBinder binds the named parameters of queries to values
+type paramBinder struct {
+	style  ParamStyle
+	lexer  sqlLexer
+	mapper IMapper
+	// native is the style of the named parameters the driver binds to
+	// sql.NamedArg, 0 when it only binds positional ones
+	native ParamStyle
+}
+
+// parse splits query around its named parameters, len(parts) is len(names)+1.
+// The parameters are only looked for in the code, not in the string literals,
+// quoted identifiers and comments.
+func (b paramBinder) parse(query string) (parts []string, names []string) {
+	prefix := b.style.prefix()
+	if strings.IndexByte(query, prefix) < 0 {
+		return []string{query}, nil
+	}
+
+	var part strings.Builder
+	part.Grow(len(query))
+	for _, seg := range b.lexer.split(query) {
+		if seg.kind != sqlCode {
+			part.WriteString(seg.text)
+			continue
+		}
+		code := seg.text
+		for i := 0; i < len(code); i++ {
+			c := code[i]
+			if c != prefix {
+				part.WriteByte(c)
+				continue
+			}
+			if prefix != '?' && i+1 < len(code) && code[i+1] == prefix {
+				// ::, @@ or $$
+				part.WriteString(code[i : i+2])
+				i++
+				continue
+			}
+			j := i + 1
+			for j < len(code) && isParamChar(code[j]) {
+				j++
+				// a path such as Author.Name
+				if j+1 < len(code) && code[j] == '.' && isParamChar(code[j+1]) {
+					j++
+				}
+			}
+			name := code[i+1 : j]
+			if name == "" || (prefix != '?' && name[0] >= '0' && name[0] <= '9') {
+				part.WriteByte(c)
+				continue
+			}
+			parts = append(parts, part.String())
+			part.Reset()
+			names = append(names, name)
+			i = j - 1
+		}
+	}
+	return append(parts, part.String()), names
+}
+
+// joinParams joins parts with the placeholders returned by fn for the named
+// parameters between them
+func joinParams(parts []string, names []string, fn func(i int, name string) string) string {
+	if len(names) == 0 {
+		return parts[0]
+	}
+	var buf strings.Builder
+	for i, name := range names {
+		buf.WriteString(parts[i])
+		buf.WriteString(fn(i, name))
+	}
+	buf.WriteString(parts[len(names)])
+	return buf.String()
+}
+
+// isNamedArg reports whether name can be the name of a sql.NamedArg
+func isNamedArg(name string) bool {
+	if name == "" || !(name[0] >= 'a' && name[0] <= 'z' || name[0] >= 'A' && name[0] <= 'Z') {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isParamChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParamStyle(t *testing.T) {
+	cases := []struct {
+		style ParamStyle
+		query string
+		res   string
+		names []string
+	}{
+		{0, "select * from user where id = ?id and name = ?name", "select * from user where id = ? and name = ?", []string{"id", "name"}},
+		{QuestionParam, "select * from user where id = ?", "select * from user where id = ?", nil},
+		{ColonParam, "select * from user where id = :id and created > :created::date", "select * from user where id = ? and created > ?::date", []string{"id", "created"}},
+		{AtParam, "select @@version, name from user where id = @id", "select @@version, name from user where id = ?", []string{"id"}},
+		{DollarParam, "select * from user where id = $1 or id = $id", "select * from user where id = $1 or id = ?", []string{"id"}},
+	}
+	for _, c := range cases {
+		plan := newQueryPlan(paramBinder{style: c.style, lexer: defaultLexer}, c.query)
+		if plan.query != c.res || !reflect.DeepEqual(plan.names, c.names) {
+			t.Fatal("unexpected", plan.query, plan.names, "for", c.query)
+		}
+	}
+}
+
+func TestMapToSliceBackslash(t *testing.T) {
+	mp := map[string]interface{}{"id": 1}
+	query, args, err := MapToSlice(`select * from t where p = 'C:\' and id = ?id`, &mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != `select * from t where p = 'C:\' and id = ?` || !reflect.DeepEqual(args, []interface{}{1}) {
+		t.Fatal("unexpected", query, args)
+	}
+}
+
+func TestExecMapParamStyle(t *testing.T) {
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetParamStyle(ColonParam)
+
+	if _, err = db.Exec(createTableSql); err != nil {
+		t.Fatal(err)
+	}
+	mp := map[string]interface{}{"name": "xlw", "title": "tester"}
+	if _, err = db.ExecMap("insert into user (`name`, title) values (:name, :title)", &mp); err != nil {
+		t.Fatal(err)
+	}
+
+	user := User{Name: "xlw"}
+	var title string
+	if err = db.QueryRowStruct("select title from user where `name` = :Name", &user).Scan(&title); err != nil {
+		t.Fatal(err)
+	}
+	if title != "tester" {
+		t.Fatal("unexpected title", title)
+	}
+
+	stmt, err := db.Prepare("select title from user where `name` = :name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	if err = stmt.QueryRowMap(&mp).Scan(&title); err != nil || title != "tester" {
+		t.Fatal("unexpected title", title, err)
+	}
+}
@@ -7,6 +7,12 @@ package core
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type PK []interface{}
@@ -16,15 +22,361 @@ func NewPK(pks ...interface{}) *PK {
 	return &p
 }
 
+// ToString encodes the PK as comma separated <type>:<value> elements, such as
+// "int64:1,string:a%2Cb". The types are the ones of RegisterPKType, bytes are
+// hex encoded and times are UTC RFC3339 with nanoseconds. An element of any
+// other type is an error.
 func (p *PK) ToString() (string, error) {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	err := enc.Encode(*p)
-	return buf.String(), err
+	var buf strings.Builder
+	for i, v := range *p {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writePKString(&buf, v); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
 }
 
+// FromString decodes a PK encoded by ToString, or by the gob encoding
+// ToString used before
 func (p *PK) FromString(content string) error {
-	dec := gob.NewDecoder(bytes.NewBufferString(content))
-	err := dec.Decode(p)
-	return err
+	if !isPKString(content) {
+		dec := gob.NewDecoder(bytes.NewBufferString(content))
+		return dec.Decode(p)
+	}
+
+	pk := make(PK, 0)
+	if content != "" {
+		for _, s := range strings.Split(content, ",") {
+			v, err := readPKString(s)
+			if err != nil {
+				return err
+			}
+			pk = append(pk, v)
+		}
+	}
+	*p = pk
+	return nil
+}
+
+// Equal reports whether both PKs have equal elements, numbers of different
+// types being equal when their values are
+func (p PK) Equal(other PK) bool {
+	return p.Compare(other) == 0
+}
+
+// Compare returns -1, 0 or 1 when p is less than, equal to or greater than
+// other, comparing their elements in order. Elements of unrelated kinds are
+// ordered as nil, bool, number, string, bytes, time then any other type.
+func (p PK) Compare(other PK) int {
+	for i := 0; i < len(p) && i < len(other); i++ {
+		if c := comparePKElem(p[i], other[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(p) < len(other):
+		return -1
+	case len(p) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// isPKString reports whether s could be written by ToString, which escapes all
+// the control characters found in gob encoded PKs
+func isPKString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func writePKString(buf *strings.Builder, v interface{}) error {
+	if v == nil {
+		buf.WriteString("nil")
+		return nil
+	}
+	name, ok := pkTypeName(reflect.TypeOf(v))
+	if !ok {
+		return fmt.Errorf("core: unsupported PK element type %T", v)
+	}
+
+	var s string
+	if t, ok := v.(time.Time); ok {
+		s = t.UTC().Format(time.RFC3339Nano)
+	} else {
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s = strconv.FormatInt(rv.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			s = strconv.FormatUint(rv.Uint(), 10)
+		case reflect.Float32, reflect.Float64:
+			s = strconv.FormatFloat(rv.Float(), 'g', -1, rv.Type().Bits())
+		case reflect.Bool:
+			s = strconv.FormatBool(rv.Bool())
+		case reflect.String:
+			s = escapePKString(rv.String())
+		case reflect.Slice:
+			if rv.Type().Elem().Kind() != reflect.Uint8 {
+				return fmt.Errorf("core: unsupported PK element type %T", v)
+			}
+			s = hex.EncodeToString(rv.Bytes())
+		default:
+			return fmt.Errorf("core: unsupported PK element type %T", v)
+		}
+	}
+
+	buf.WriteString(escapePKString(name))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+	return nil
+}
+
+func readPKString(s string) (interface{}, error) {
+	if s == "nil" {
+		return nil, nil
+	}
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("core: bad PK element %q", s)
+	}
+	name, err := unescapePKString(s[:i])
+	if err != nil {
+		return nil, err
+	}
+	t, ok := pkType(name)
+	if !ok {
+		return nil, fmt.Errorf("core: unknown PK element type %s", name)
+	}
+	s = s[i+1:]
+
+	if t == TimeType {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	rv := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(s, 10, t.Bits()); err == nil {
+			rv.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		if n, err = strconv.ParseUint(s, 10, t.Bits()); err == nil {
+			rv.SetUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(s, t.Bits()); err == nil {
+			rv.SetFloat(f)
+		}
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(s); err == nil {
+			rv.SetBool(b)
+		}
+	case reflect.String:
+		if s, err = unescapePKString(s); err == nil {
+			rv.SetString(s)
+		}
+	case reflect.Slice:
+		var b []byte
+		if b, err = hex.DecodeString(s); err == nil {
+			rv.SetBytes(b)
+		}
+	default:
+		err = fmt.Errorf("core: unsupported PK element type %s", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rv.Interface(), nil
+}
+
+const pkHex = "0123456789ABCDEF"
+
+// escapePKString percent-encodes '%', ',', ':' and the control characters
+func escapePKString(s string) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' || c == ',' || c == ':' || c < 0x20 || c == 0x7f {
+			if buf == nil {
+				buf = append(make([]byte, 0, len(s)+8), s[:i]...)
+			}
+			buf = append(buf, '%', pkHex[c>>4], pkHex[c&15])
+		} else if buf != nil {
+			buf = append(buf, c)
+		}
+	}
+	if buf == nil {
+		return s
+	}
+	return string(buf)
+}
+
+func unescapePKString(s string) (string, error) {
+	if strings.IndexByte(s, '%') < 0 {
+		return s, nil
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			buf = append(buf, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("core: bad escape in PK element %q", s)
+		}
+		b, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("core: bad escape in PK element %q", s)
+		}
+		buf = append(buf, b[0])
+		i += 2
+	}
+	return string(buf), nil
+}
+
+// the classes of PK elements which compare with each other
+const (
+	pkClassNil = iota
+	pkClassBool
+	pkClassNumber
+	pkClassString
+	pkClassBytes
+	pkClassTime
+	pkClassOther
+)
+
+func pkClass(v interface{}) (int, reflect.Value) {
+	if v == nil {
+		return pkClassNil, reflect.Value{}
+	}
+	if _, ok := v.(time.Time); ok {
+		return pkClassTime, reflect.ValueOf(v)
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool:
+		return pkClassBool, rv
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return pkClassNumber, rv
+	case reflect.String:
+		return pkClassString, rv
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return pkClassBytes, rv
+		}
+	}
+	return pkClassOther, rv
+}
+
+func comparePKElem(a, b interface{}) int {
+	ac, av := pkClass(a)
+	bc, bv := pkClass(b)
+	if ac != bc {
+		return compareInts(int64(ac), int64(bc))
+	}
+
+	switch ac {
+	case pkClassNil:
+		return 0
+	case pkClassBool:
+		if av.Bool() == bv.Bool() {
+			return 0
+		}
+		if bv.Bool() {
+			return -1
+		}
+		return 1
+	case pkClassNumber:
+		return compareNumbers(av, bv)
+	case pkClassString:
+		return strings.Compare(av.String(), bv.String())
+	case pkClassBytes:
+		return bytes.Compare(av.Bytes(), bv.Bytes())
+	case pkClassTime:
+		at, bt := a.(time.Time), b.(time.Time)
+		switch {
+		case at.Before(bt):
+			return -1
+		case at.After(bt):
+			return 1
+		}
+		return 0
+	}
+	if c := strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b)); c != 0 {
+		return c
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareNumbers(a, b reflect.Value) int {
+	isInt := func(v reflect.Value) bool { return v.Kind() >= reflect.Int && v.Kind() <= reflect.Int64 }
+	isUint := func(v reflect.Value) bool { return v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64 }
+
+	switch {
+	case isInt(a) && isInt(b):
+		return compareInts(a.Int(), b.Int())
+	case isUint(a) && isUint(b):
+		return compareUints(a.Uint(), b.Uint())
+	case isInt(a) && isUint(b):
+		if a.Int() < 0 {
+			return -1
+		}
+		return compareUints(uint64(a.Int()), b.Uint())
+	case isUint(a) && isInt(b):
+		if b.Int() < 0 {
+			return 1
+		}
+		return compareUints(a.Uint(), uint64(b.Int()))
+	}
+
+	af, bf := numberFloat(a), numberFloat(b)
+	switch {
+	case af < bf:
+		return -1
+	case af > bf:
+		return 1
+	}
+	return 0
+}
+
+func compareUints(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func numberFloat(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	}
+	return v.Float()
 }
@@ -5,8 +5,11 @@
 package core
 
 import (
+	"bytes"
+	"encoding/gob"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestPK(t *testing.T) {
@@ -34,3 +37,74 @@ func TestPK(t *testing.T) {
 		}
 	}
 }
+
+func TestPKString(t *testing.T) {
+	created := time.Date(2019, 1, 2, 3, 4, 5, 6, time.FixedZone("CST", 8*3600))
+	p := NewPK(int64(-1), uint8(2), 1.5, true, "a,b:c%d\n", []byte{0xca, 0xfe}, created, nil)
+	str, err := p.ToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `int64:-1,uint8:2,float64:1.5,bool:true,string:a%2Cb%3Ac%25d%0A,bytes:cafe,time:2019-01-01T19:04:05.000000006Z,nil`
+	if str != expected {
+		t.Fatal("unexpected string", str)
+	}
+
+	s := &PK{}
+	if err = s.FromString(str); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual((*s)[:6], (*p)[:6]) || !(*s)[6].(time.Time).Equal(created) || (*s)[7] != nil {
+		t.Fatal("p", *p, "should be equal", *s)
+	}
+
+	if _, err = NewPK(struct{}{}).ToString(); err == nil {
+		t.Fatal("an unsupported element should be an error")
+	}
+	if err = s.FromString("int64:x"); err == nil {
+		t.Fatal("a bad element should be an error")
+	}
+	if err = s.FromString(""); err != nil || len(*s) != 0 {
+		t.Fatal("an empty string should be an empty PK", *s, err)
+	}
+
+	// PKs encoded with gob are still decoded
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(PK{1, "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.FromString(buf.String()); err != nil || !s.Equal(PK{1, "a"}) {
+		t.Fatal("gob encoded PK should be decoded, got", *s, err)
+	}
+}
+
+func TestPKCompare(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		a, b PK
+		c    int
+	}{
+		{PK{1, "a"}, PK{int64(1), "a"}, 0},
+		{PK{uint(1)}, PK{int8(1)}, 0},
+		{PK{1.0}, PK{1}, 0},
+		{PK{-1}, PK{uint64(0)}, -1},
+		{PK{uint64(1 << 63)}, PK{int64(1<<63 - 1)}, 1},
+		{PK{1, "a"}, PK{1, "b"}, -1},
+		{PK{1}, PK{1, "a"}, -1},
+		{PK{[]byte("b")}, PK{[]byte("a")}, 1},
+		{PK{now}, PK{now.Add(time.Second)}, -1},
+		{PK{nil}, PK{0}, -1},
+		{PK{false}, PK{true}, -1},
+	}
+	for _, c := range cases {
+		if res := c.a.Compare(c.b); res != c.c {
+			t.Fatal(c.a, "compared to", c.b, "should be", c.c, "got", res)
+		}
+		if res := c.b.Compare(c.a); res != -c.c {
+			t.Fatal(c.b, "compared to", c.a, "should be", -c.c, "got", res)
+		}
+		if c.a.Equal(c.b) != (c.c == 0) {
+			t.Fatal(c.a, "equal to", c.b, "should be", c.c == 0)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"container/list"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// queryPlan is a query with named parameters compiled once for all the
+// values bound to it
+type queryPlan struct {
+	// query has a ? placeholder for every named parameter
+	query string
+	// parts are the SQL around the named parameters
+	parts  []string
+	names  []string
+	mapper IMapper
+	// native has the named parameters of the driver in place of the ones of
+	// query, it is empty when they cannot be bound to sql.NamedArg
+	native string
+
+	mutex sync.RWMutex
+	// the paths of the fields of the names by struct type
+	fields map[reflect.Type][]fieldPath
+}
+
+func newQueryPlan(b paramBinder, query string) *queryPlan {
+	parts, names := b.parse(query)
+	p := &queryPlan{
+		query:  joinParams(parts, names, func(int, string) string { return "?" }),
+		parts:  parts,
+		names:  names,
+		mapper: b.mapper,
+	}
+	if b.native == 0 || b.native == QuestionParam || len(names) == 0 {
+		return p
+	}
+	for _, name := range names {
+		if !isNamedArg(name) {
+			return p
+		}
+	}
+	prefix := string(b.native)
+	p.native = joinParams(parts, names, func(_ int, name string) string { return prefix + name })
+	return p
+}
+
+// prepared returns the query to prepare, the arguments of its statement
+// being the ones returned by namedArgs
+func (p *queryPlan) prepared() string {
+	if p.native != "" {
+		return p.native
+	}
+	return p.query
+}
+
+// namedArgs returns the values of the named parameters as sql.NamedArg when
+// the driver binds them, once for each name
+func (p *queryPlan) namedArgs(values []interface{}) []interface{} {
+	if p.native == "" {
+		return values
+	}
+	args := make([]interface{}, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for i, name := range p.names {
+		if !seen[name] {
+			seen[name] = true
+			args = append(args, sql.Named(name, values[i]))
+		}
+	}
+	return args
+}
+
+// fieldPaths returns the paths of the fields of the struct type t named by
+// the parameters
+func (p *queryPlan) fieldPaths(t reflect.Type) ([]fieldPath, error) {
+	p.mutex.RLock()
+	paths, ok := p.fields[t]
+	p.mutex.RUnlock()
+	if ok {
+		return paths, nil
+	}
+
+	paths = make([]fieldPath, len(p.names))
+	for i, name := range p.names {
+		var err error
+		if paths[i], err = compileFieldPath(t, name, p.mapper); err != nil {
+			return nil, err
+		}
+	}
+
+	p.mutex.Lock()
+	if p.fields == nil {
+		p.fields = make(map[reflect.Type][]fieldPath)
+	}
+	p.fields[t] = paths
+	p.mutex.Unlock()
+	return paths, nil
+}
+
+// bind returns the query and the arguments of the values of the named
+// parameters, the slices and arrays but []byte being expanded. They are
+// sql.NamedArg when the driver binds them and nothing is expanded.
+func (p *queryPlan) bind(value func(i int, name string) (interface{}, error)) (string, []interface{}, error) {
+	args := make([]interface{}, 0, len(p.names))
+	var placeholders []string
+	for i, name := range p.names {
+		v, err := value(i, name)
+		if err != nil {
+			return "", []interface{}{}, err
+		}
+		if !isExpandedArg(v) {
+			args = append(args, v)
+			continue
+		}
+		if placeholders == nil {
+			placeholders = make([]string, len(p.names))
+			for j := range placeholders {
+				placeholders[j] = "?"
+			}
+		}
+		if placeholders[i], args, err = expandArg(name, v, args); err != nil {
+			return "", []interface{}{}, err
+		}
+	}
+	if placeholders == nil {
+		if p.native != "" {
+			return p.native, p.namedArgs(args), nil
+		}
+		return p.query, args, nil
+	}
+	return joinParams(p.parts, p.names, func(i int, _ string) string {
+		return placeholders[i]
+	}), args, nil
+}
+
+func (p *queryPlan) mapToSlice(mp interface{}) (string, []interface{}, error) {
+	vv := reflect.ValueOf(mp)
+	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Map {
+		return "", []interface{}{}, ErrNoMapPointer
+	}
+	return p.bind(func(i int, name string) (interface{}, error) {
+		v := vv.Elem().MapIndex(reflect.ValueOf(name))
+		if !v.IsValid() {
+			return nil, fmt.Errorf("map key %s is missing", name)
+		}
+		return v.Interface(), nil
+	})
+}
+
+func (p *queryPlan) structToSlice(st interface{}) (string, []interface{}, error) {
+	vv := reflect.ValueOf(st)
+	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Struct {
+		return "", []interface{}{}, ErrNoStructPointer
+	}
+	paths, err := p.fieldPaths(vv.Elem().Type())
+	if err != nil {
+		return "", []interface{}{}, err
+	}
+	return p.bind(func(i int, name string) (interface{}, error) {
+		field, err := paths[i].value(vv.Elem(), name)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := field.Interface().(driver.Valuer); ok {
+			return v.Value()
+		}
+		return field.Interface(), nil
+	})
+}
+
+// fieldPath is the indexes of the fields named by the parts of a parameter,
+// the pointers between them being followed
+type fieldPath [][]int
+
+// compileFieldPath returns the path of the field of the struct type t named
+// by the parameter name, see structField
+func compileFieldPath(t reflect.Type, name string, mapper IMapper) (fieldPath, error) {
+	parts := strings.Split(name, ".")
+	path := make(fieldPath, len(parts))
+	for i, part := range parts {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("field %s of %s is not a struct", strings.Join(parts[:i], "."), name)
+		}
+		index, ok := fieldIndex(t, part, mapper)
+		if !ok {
+			return nil, fmt.Errorf("struct %v has no field or column %s", t, part)
+		}
+		path[i] = index
+		t = t.FieldByIndex(index).Type
+	}
+	return path, nil
+}
+
+// value returns the field of v the path leads to
+func (p fieldPath) value(v reflect.Value, name string) (reflect.Value, error) {
+	for i, index := range p {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, fmt.Errorf("field %s of %s is nil", strings.Join(strings.Split(name, ".")[:i], "."), name)
+			}
+			v = v.Elem()
+		}
+		var err error
+		if v, err = fieldByIndex(v, index); err != nil {
+			return reflect.Value{}, fmt.Errorf("field %s of %s: %v", strings.Split(name, ".")[i], name, err)
+		}
+	}
+	return v, nil
+}
+
+type planKey struct {
+	style  ParamStyle
+	lexer  sqlLexer
+	native ParamStyle
+	query  string
+}
+
+type planEntry struct {
+	key  planKey
+	plan *queryPlan
+}
+
+// planCache keeps the most recently used query plans
+type planCache struct {
+	mutex sync.Mutex
+	size  int
+	list  *list.List
+	plans map[planKey]*list.Element
+}
+
+func newPlanCache(size int) *planCache {
+	return &planCache{
+		size:  size,
+		list:  list.New(),
+		plans: make(map[planKey]*list.Element),
+	}
+}
+
+// get returns the plan of query, compiling it when it is not cached
+func (c *planCache) get(b paramBinder, query string) *queryPlan {
+	key := planKey{b.style, b.lexer, b.native, query}
+	c.mutex.Lock()
+	if e, ok := c.plans[key]; ok {
+		c.list.MoveToFront(e)
+		c.mutex.Unlock()
+		return e.Value.(*planEntry).plan
+	}
+	c.mutex.Unlock()
+
+	plan := newQueryPlan(b, query)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.plans[key]; ok {
+		c.list.MoveToFront(e)
+		return e.Value.(*planEntry).plan
+	}
+	if c.size > 0 {
+		c.plans[key] = c.list.PushFront(&planEntry{key, plan})
+		c.evict()
+	}
+	return plan
+}
+
+// reset drops all the cached plans
+func (c *planCache) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.list.Init()
+	c.plans = make(map[planKey]*list.Element)
+}
+
+// resize sets the number of cached plans, 0 disables the cache
+func (c *planCache) resize(size int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.size = size
+	c.evict()
+}
+
+func (c *planCache) evict() {
+	for c.list.Len() > c.size {
+		e := c.list.Back()
+		c.list.Remove(e)
+		delete(c.plans, e.Value.(*planEntry).key)
+	}
+}
+
+// len returns the number of cached plans
+func (c *planCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.list.Len()
+}
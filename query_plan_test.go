@@ -0,0 +1,227 @@
+// Copyright 2019 The Xorm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanCache(t *testing.T) {
+	b := paramBinder{style: QuestionParam, lexer: defaultLexer}
+	c := newPlanCache(2)
+
+	p1 := c.get(b, "select ?a")
+	if c.get(b, "select ?a") != p1 {
+		t.Fatal("the plan should be cached")
+	}
+	if c.get(paramBinder{style: ColonParam, lexer: defaultLexer}, "select ?a") == p1 {
+		t.Fatal("the plans of other styles should differ")
+	}
+	c.get(b, "select ?a")
+	c.get(b, "select ?b")
+	if c.len() != 2 {
+		t.Fatal("the cache should be bounded but has", c.len(), "plans")
+	}
+	if c.get(b, "select ?a") != p1 {
+		t.Fatal("the most recently used plan should be kept")
+	}
+
+	c.resize(0)
+	if c.len() != 0 || c.get(b, "select ?a") == p1 || c.len() != 0 {
+		t.Fatal("a cache of size 0 should be disabled")
+	}
+}
+
+func TestQueryPlanStruct(t *testing.T) {
+	type Author struct {
+		Name string
+	}
+	type Post struct {
+		Id     int64
+		Title  string `xorm:"'post_title'"`
+		Author *Author
+		Tags   []string
+	}
+	type Page struct {
+		Id    string
+		Title string
+	}
+
+	plan := newQueryPlan(paramBinder{style: QuestionParam, lexer: defaultLexer, mapper: SnakeMapper{}},
+		"select * from post where id = ?id and post_title = ?Title and author = ?Author.Name and tag in (?Tags)")
+	query, args, err := plan.structToSlice(&Post{1, "xorm", &Author{"xlw"}, []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != "select * from post where id = ? and post_title = ? and author = ? and tag in (?, ?)" ||
+		!reflect.DeepEqual(args, []interface{}{int64(1), "xorm", "xlw", "a", "b"}) {
+		t.Fatal("unexpected", query, args)
+	}
+
+	if _, _, err = plan.structToSlice(&Post{Id: 1}); err == nil {
+		t.Fatal("a nil Author should be an error")
+	}
+	if _, _, err = plan.structToSlice(&Page{"a", "b"}); err == nil {
+		t.Fatal("a struct without Author should be an error")
+	}
+	if len(plan.fields) != 1 {
+		t.Fatal("the fields of Post should be cached")
+	}
+}
+
+func TestDBPlanCache(t *testing.T) {
+	db, err := testOpen(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mp := map[string]interface{}{"id": 1}
+	for i := 0; i < 2; i++ {
+		query, args, err := db.plan("select * from user where id = ?id").mapToSlice(&mp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query != "select * from user where id = ?" || len(args) != 1 {
+			t.Fatal("unexpected", query, args)
+		}
+	}
+	if db.plans.len() != 1 {
+		t.Fatal("the plan should be cached once but there are", db.plans.len())
+	}
+
+	type Post struct {
+		PostTitle string
+	}
+	post := Post{"xorm"}
+	query := "select * from post where title = ?post_title"
+	if _, _, err = db.plan(query).structToSlice(&post); err != nil {
+		t.Fatal(err)
+	}
+	db.SetMapper(SameMapper{})
+	if db.plans.len() != 0 {
+		t.Fatal("the plans should be dropped with the mapper")
+	}
+	if _, _, err = db.plan(query).structToSlice(&post); err == nil {
+		t.Fatal("the plan should use the new mapper")
+	}
+	db.SetMapper(NewPrefixMapper(GonicMapper{}, ""))
+	plan := db.plan(query)
+	if _, _, err = plan.structToSlice(&post); err != nil {
+		t.Fatal(err)
+	}
+	if db.plan(query) != plan {
+		t.Fatal("the plan should be compiled once")
+	}
+
+	db.SetPlanCacheSize(0)
+	if db.plans.len() != 0 {
+		t.Fatal("the plans should be dropped")
+	}
+}
+
+const benchPlanQuery = "insert into user (`name`, title, age, alias, nick_name, created) " +
+	"values (?name,?title,?age,?alias,?nick_name,?created)"
+
+func benchPlanMap() map[string]interface{} {
+	return map[string]interface{}{
+		"name":      "xlw",
+		"title":     "tester",
+		"age":       1.2,
+		"alias":     "lunny",
+		"nick_name": "lunny xiao",
+		"created":   time.Now(),
+	}
+}
+
+// BenchmarkMapToSlice compiles the query every time, as MapToSlice does
+func BenchmarkMapToSlice(b *testing.B) {
+	mp := benchPlanMap()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := MapToSlice(benchPlanQuery, &mp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPlanMapToSlice(b *testing.B) {
+	db := FromDB(nil)
+	mp := benchPlanMap()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := db.plan(benchPlanQuery).mapToSlice(&mp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStructToSlice compiles the query every time, as a DB without plan
+// cache does
+func BenchmarkStructToSlice(b *testing.B) {
+	db := FromDB(nil)
+	db.SetPlanCacheSize(0)
+	user := User{Name: "xlw", Title: "tester", Age: 1.2, Alias: "lunny", NickName: "lunny xiao", Created: NullTime(time.Now())}
+	for i := 0; i < b.N; i++ {
+		if _, _, err := db.plan(benchPlanQuery).structToSlice(&user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPlanStructToSlice(b *testing.B) {
+	db := FromDB(nil)
+	user := User{Name: "xlw", Title: "tester", Age: 1.2, Alias: "lunny", NickName: "lunny xiao", Created: NullTime(time.Now())}
+	for i := 0; i < b.N; i++ {
+		if _, _, err := db.plan(benchPlanQuery).structToSlice(&user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExecMapNoPlan is BenchmarkExecMap compiling the query every time
+func BenchmarkExecMapNoPlan(b *testing.B) {
+	b.StopTimer()
+	db, err := testOpen(b)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.SetPlanCacheSize(0)
+	if _, err = db.Exec(createTableSql); err != nil {
+		b.Fatal(err)
+	}
+	mp := benchPlanMap()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err = db.ExecMap(benchPlanQuery, &mp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExecStructNoPlan is BenchmarkExecStruct compiling the query every
+// time
+func BenchmarkExecStructNoPlan(b *testing.B) {
+	b.StopTimer()
+	db, err := testOpen(b)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	db.SetPlanCacheSize(0)
+	if _, err = db.Exec(createTableSql); err != nil {
+		b.Fatal(err)
+	}
+	user := User{Name: "xlw", Title: "tester", Age: 1.2, Alias: "lunny", NickName: "lunny xiao", Created: NullTime(time.Now())}
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err = db.ExecStruct(benchPlanQuery, &user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -7,47 +7,95 @@ package core
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"fmt"
 	"reflect"
 )
 
 type Stmt struct {
 	*sql.Stmt
-	db    *DB
-	names map[string]int
+	db *DB
+	// the named parameters of every placeholder, in order
+	plan *queryPlan
+	// the prepared SQL
+	query string
 }
 
 func (db *DB) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
-	names := make(map[string]int)
-	var i int
-	query = re.ReplaceAllStringFunc(query, func(src string) string {
-		names[src[1:]] = i
-		i += 1
-		return "?"
-	})
-
+	plan := db.plan(query)
+	query = db.filter(plan.prepared())
 	stmt, err := db.DB.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
-	return &Stmt{stmt, db, names}, nil
+	return &Stmt{stmt, db, plan, query}, nil
 }
 
 func (db *DB) Prepare(query string) (*Stmt, error) {
 	return db.PrepareContext(context.Background(), query)
 }
 
-func (s *Stmt) ExecMapContext(ctx context.Context, mp interface{}) (sql.Result, error) {
+// checkStmtArg returns an error when v would be expanded by MapToSlice or
+// StructToSlice, which cannot be done once the statement is prepared
+func checkStmtArg(name string, v interface{}) error {
+	if isExpandedArg(v) {
+		return fmt.Errorf("named parameter %s of a prepared statement cannot be a %T", name, v)
+	}
+	return nil
+}
+
+// mapArgs returns the values of the map mp points to for all the placeholders
+func (s *Stmt) mapArgs(mp interface{}) ([]interface{}, error) {
 	vv := reflect.ValueOf(mp)
 	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Map {
-		return nil, errors.New("mp should be a map's pointer")
+		return nil, ErrNoMapPointer
 	}
 
-	args := make([]interface{}, len(s.names))
-	for k, i := range s.names {
-		args[i] = vv.Elem().MapIndex(reflect.ValueOf(k)).Interface()
+	args := make([]interface{}, len(s.plan.names))
+	for i, name := range s.plan.names {
+		v := vv.Elem().MapIndex(reflect.ValueOf(name))
+		if !v.IsValid() {
+			return nil, fmt.Errorf("map key %s is missing", name)
+		}
+		args[i] = v.Interface()
+		if err := checkStmtArg(name, args[i]); err != nil {
+			return nil, err
+		}
 	}
-	return s.Stmt.ExecContext(ctx, args...)
+	return s.plan.namedArgs(args), nil
+}
+
+// structArgs returns the fields of the struct st points to for all the
+// placeholders
+func (s *Stmt) structArgs(st interface{}) ([]interface{}, error) {
+	vv := reflect.ValueOf(st)
+	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Struct {
+		return nil, ErrNoStructPointer
+	}
+
+	paths, err := s.plan.fieldPaths(vv.Elem().Type())
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(s.plan.names))
+	for i, name := range s.plan.names {
+		field, err := paths[i].value(vv.Elem(), name)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = field.Interface()
+		if err := checkStmtArg(name, args[i]); err != nil {
+			return nil, err
+		}
+	}
+	return s.plan.namedArgs(args), nil
+}
+
+func (s *Stmt) ExecMapContext(ctx context.Context, mp interface{}) (sql.Result, error) {
+	args, err := s.mapArgs(mp)
+	if err != nil {
+		return nil, err
+	}
+	return s.ExecContext(ctx, args...)
 }
 
 func (s *Stmt) ExecMap(mp interface{}) (sql.Result, error) {
@@ -55,23 +103,56 @@ func (s *Stmt) ExecMap(mp interface{}) (sql.Result, error) {
 }
 
 func (s *Stmt) ExecStructContext(ctx context.Context, st interface{}) (sql.Result, error) {
-	vv := reflect.ValueOf(st)
-	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Struct {
-		return nil, errors.New("mp should be a map's pointer")
+	args, err := s.structArgs(st)
+	if err != nil {
+		return nil, err
 	}
+	return s.ExecContext(ctx, args...)
+}
+
+func (s *Stmt) ExecStruct(st interface{}) (sql.Result, error) {
+	return s.ExecStructContext(context.Background(), st)
+}
+
+// filterArgs applies the ArgFilters of the dialect of the DB to args and to
+// the prepared SQL, which they must leave unchanged
+func (s *Stmt) filterArgs(args []interface{}) ([]interface{}, error) {
+	for _, f := range s.db.filters {
+		af, ok := f.(ArgFilter)
+		if !ok {
+			continue
+		}
+		query, res, err := af.DoArgs(s.query, args, s.db.dialect, nil)
+		if err != nil {
+			return nil, err
+		}
+		if query != s.query {
+			return nil, fmt.Errorf("filter %T changed the SQL of a prepared statement to %s", f, query)
+		}
+		args = res
+	}
+	return args, nil
+}
 
-	args := make([]interface{}, len(s.names))
-	for k, i := range s.names {
-		args[i] = vv.Elem().FieldByName(k).Interface()
+// ExecContext overwrites sql.Stmt.ExecContext
+func (s *Stmt) ExecContext(ctx context.Context, args ...interface{}) (sql.Result, error) {
+	args, err := s.filterArgs(args)
+	if err != nil {
+		return nil, err
 	}
 	return s.Stmt.ExecContext(ctx, args...)
 }
 
-func (s *Stmt) ExecStruct(st interface{}) (sql.Result, error) {
-	return s.ExecStructContext(context.Background(), st)
+// Exec overwrites sql.Stmt.Exec
+func (s *Stmt) Exec(args ...interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), args...)
 }
 
 func (s *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*Rows, error) {
+	args, err := s.filterArgs(args)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := s.Stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return nil, err
@@ -84,16 +165,10 @@ func (s *Stmt) Query(args ...interface{}) (*Rows, error) {
 }
 
 func (s *Stmt) QueryMapContext(ctx context.Context, mp interface{}) (*Rows, error) {
-	vv := reflect.ValueOf(mp)
-	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Map {
-		return nil, errors.New("mp should be a map's pointer")
-	}
-
-	args := make([]interface{}, len(s.names))
-	for k, i := range s.names {
-		args[i] = vv.Elem().MapIndex(reflect.ValueOf(k)).Interface()
+	args, err := s.mapArgs(mp)
+	if err != nil {
+		return nil, err
 	}
-
 	return s.QueryContext(ctx, args...)
 }
 
@@ -102,17 +177,11 @@ func (s *Stmt) QueryMap(mp interface{}) (*Rows, error) {
 }
 
 func (s *Stmt) QueryStructContext(ctx context.Context, st interface{}) (*Rows, error) {
-	vv := reflect.ValueOf(st)
-	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Struct {
-		return nil, errors.New("mp should be a map's pointer")
-	}
-
-	args := make([]interface{}, len(s.names))
-	for k, i := range s.names {
-		args[i] = vv.Elem().FieldByName(k).Interface()
+	args, err := s.structArgs(st)
+	if err != nil {
+		return nil, err
 	}
-
-	return s.Query(args...)
+	return s.QueryContext(ctx, args...)
 }
 
 func (s *Stmt) QueryStruct(st interface{}) (*Rows, error) {
@@ -129,16 +198,10 @@ func (s *Stmt) QueryRow(args ...interface{}) *Row {
 }
 
 func (s *Stmt) QueryRowMapContext(ctx context.Context, mp interface{}) *Row {
-	vv := reflect.ValueOf(mp)
-	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Map {
-		return &Row{nil, errors.New("mp should be a map's pointer")}
-	}
-
-	args := make([]interface{}, len(s.names))
-	for k, i := range s.names {
-		args[i] = vv.Elem().MapIndex(reflect.ValueOf(k)).Interface()
+	args, err := s.mapArgs(mp)
+	if err != nil {
+		return &Row{nil, err}
 	}
-
 	return s.QueryRowContext(ctx, args...)
 }
 
@@ -147,16 +210,10 @@ func (s *Stmt) QueryRowMap(mp interface{}) *Row {
 }
 
 func (s *Stmt) QueryRowStructContext(ctx context.Context, st interface{}) *Row {
-	vv := reflect.ValueOf(st)
-	if vv.Kind() != reflect.Ptr || vv.Elem().Kind() != reflect.Struct {
-		return &Row{nil, errors.New("st should be a struct's pointer")}
-	}
-
-	args := make([]interface{}, len(s.names))
-	for k, i := range s.names {
-		args[i] = vv.Elem().FieldByName(k).Interface()
+	args, err := s.structArgs(st)
+	if err != nil {
+		return &Row{nil, err}
 	}
-
 	return s.QueryRowContext(ctx, args...)
 }
 
@@ -5,6 +5,7 @@
 package core
 
 import (
+	"fmt"
 	"reflect"
 	"strings"
 )
@@ -96,6 +97,58 @@ func (table *Table) PKColumns() []*Column {
 	return columns
 }
 
+// PKOf returns the values of the primary key columns of bean
+func (table *Table) PKOf(bean interface{}) (PK, error) {
+	if len(table.PrimaryKeys) == 0 {
+		return nil, fmt.Errorf("table %v has no primary key", table.Name)
+	}
+	v := reflect.ValueOf(bean)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, fmt.Errorf("table %v: bean is nil", table.Name)
+	}
+	if v = reflect.Indirect(v); v.Kind() != reflect.Struct && v.Kind() != reflect.Map {
+		return nil, fmt.Errorf("table %v: bean %T is neither a struct nor a map", table.Name, bean)
+	}
+	pk := make(PK, 0, len(table.PrimaryKeys))
+	for i, col := range table.PKColumns() {
+		if col == nil {
+			return nil, fmt.Errorf("table %v has no column %v", table.Name, table.PrimaryKeys[i])
+		}
+		fieldValue, err := col.ValueOfV(&v)
+		if err != nil {
+			return nil, err
+		}
+		if !fieldValue.IsValid() {
+			return nil, fmt.Errorf("table %v: bean has no value of %v", table.Name, col.Name)
+		}
+		if !fieldValue.CanInterface() {
+			return nil, fmt.Errorf("table %v: field %v is unexported", table.Name, col.FieldName)
+		}
+		pk = append(pk, fieldValue.Interface())
+	}
+	return pk, nil
+}
+
+// PKCondition returns the "col1 = ? AND col2 = ?" condition matching the
+// primary key pk, with its args
+func (table *Table) PKCondition(dialect Dialect, pk PK) (string, []interface{}, error) {
+	if len(table.PrimaryKeys) == 0 {
+		return "", nil, fmt.Errorf("table %v has no primary key", table.Name)
+	}
+	if len(pk) != len(table.PrimaryKeys) {
+		return "", nil, fmt.Errorf("table %v has %d primary key columns but got %d values",
+			table.Name, len(table.PrimaryKeys), len(pk))
+	}
+
+	conds := make([]string, len(table.PrimaryKeys))
+	for i, name := range table.PrimaryKeys {
+		conds[i] = fmt.Sprintf("%s %s ?", dialect.Quote(name), dialect.EqStr())
+	}
+	args := make([]interface{}, len(pk))
+	copy(args, pk)
+	return strings.Join(conds, " "+dialect.AndStr()+" "), args, nil
+}
+
 func (table *Table) ColumnType(name string) reflect.Type {
 	t, _ := table.Type.FieldByName(name)
 	return t.Type
@@ -5,6 +5,7 @@
 package core
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -109,3 +110,69 @@ func BenchmarkGetColumnIdx(b *testing.B) {
 		}
 	}
 }
+
+type pkDialect struct {
+	Dialect
+}
+
+func (pkDialect) Quote(name string) string { return "`" + name + "`" }
+func (pkDialect) EqStr() string            { return "=" }
+func (pkDialect) AndStr() string           { return "AND" }
+
+func TestTablePK(t *testing.T) {
+	type UserGroup struct {
+		UserId  int64
+		GroupId string
+		Name    string
+	}
+
+	tb := NewTable("user_group", reflect.TypeOf(UserGroup{}))
+	tb.AddColumn(&Column{Name: "user_id", FieldName: "UserId", IsPrimaryKey: true})
+	tb.AddColumn(&Column{Name: "group_id", FieldName: "GroupId", IsPrimaryKey: true})
+	tb.AddColumn(&Column{Name: "name", FieldName: "Name"})
+
+	pk, err := tb.PKOf(&UserGroup{1, "admin", "xlw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pk.Equal(PK{int64(1), "admin"}) {
+		t.Fatal("unexpected pk", pk)
+	}
+
+	cond, args, err := tb.PKCondition(pkDialect{}, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cond != "`user_id` = ? AND `group_id` = ?" || len(args) != 2 || args[0] != int64(1) || args[1] != "admin" {
+		t.Fatal("unexpected condition", cond, args)
+	}
+
+	if _, _, err = tb.PKCondition(pkDialect{}, PK{1}); err == nil {
+		t.Fatal("a PK with missing values should be an error")
+	}
+	if _, err = NewEmptyTable().PKOf(&UserGroup{}); err == nil {
+		t.Fatal("a table without primary key should be an error")
+	}
+
+	pk, err = tb.PKOf(map[string]interface{}{"UserId": int64(2), "GroupId": "users"})
+	if err != nil || !pk.Equal(PK{int64(2), "users"}) {
+		t.Fatal("unexpected pk of a map", pk, err)
+	}
+	if _, err = tb.PKOf(map[string]interface{}{"Name": "xlw"}); err == nil {
+		t.Fatal("a map without the PK should be an error")
+	}
+	for _, bean := range []interface{}{nil, (*UserGroup)(nil), 1} {
+		if _, err = tb.PKOf(bean); err == nil {
+			t.Fatalf("%#v should be an error", bean)
+		}
+	}
+
+	type hidden struct {
+		id int64
+	}
+	tb = NewTable("hidden", reflect.TypeOf(hidden{}))
+	tb.AddColumn(&Column{Name: "id", FieldName: "id", IsPrimaryKey: true})
+	if _, err = tb.PKOf(&hidden{1}); err == nil {
+		t.Fatal("an unexported PK field should be an error")
+	}
+}
@@ -11,7 +11,8 @@ import (
 
 type Tx struct {
 	*sql.Tx
-	db *DB
+	db    *DB
+	cache *txCache
 }
 
 func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
@@ -19,7 +20,7 @@ func (db *DB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*Tx, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Tx{tx, db}, nil
+	return &Tx{tx, db, &txCache{}}, nil
 }
 
 func (db *DB) Begin() (*Tx, error) {
@@ -27,23 +28,40 @@ func (db *DB) Begin() (*Tx, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Tx{tx, db}, nil
+	return &Tx{tx, db, &txCache{}}, nil
 }
 
-func (tx *Tx) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
-	names := make(map[string]int)
-	var i int
-	query = re.ReplaceAllStringFunc(query, func(src string) string {
-		names[src[1:]] = i
-		i += 1
-		return "?"
-	})
+// Commit commits the transaction, then applies the cache operations done
+// through the Cachers of tx
+func (tx *Tx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		tx.cache.finish(false)
+		return err
+	}
+	// the data is committed, a failing cache operation is not an error of
+	// the commit
+	for _, op := range tx.cache.finish(true) {
+		op(context.Background())
+	}
+	return nil
+}
+
+// Rollback aborts the transaction and drops the cache operations done through
+// the Cachers of tx
+func (tx *Tx) Rollback() error {
+	err := tx.Tx.Rollback()
+	tx.cache.finish(false)
+	return err
+}
 
+func (tx *Tx) PrepareContext(ctx context.Context, query string) (*Stmt, error) {
+	plan := tx.db.plan(query)
+	query = tx.db.filter(plan.prepared())
 	stmt, err := tx.Tx.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
-	return &Stmt{stmt, tx.db, names}, nil
+	return &Stmt{stmt, tx.db, plan, query}, nil
 }
 
 func (tx *Tx) Prepare(query string) (*Stmt, error) {
@@ -59,24 +77,38 @@ func (tx *Tx) Stmt(stmt *Stmt) *Stmt {
 	return tx.StmtContext(context.Background(), stmt)
 }
 
-func (tx *Tx) ExecMapContext(ctx context.Context, query string, mp interface{}) (sql.Result, error) {
-	query, args, err := MapToSlice(query, mp)
+// ExecContext overwrites sql.Tx.ExecContext
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	query, args, err := tx.db.filterArgs(query, args)
 	if err != nil {
 		return nil, err
 	}
 	return tx.Tx.ExecContext(ctx, query, args...)
 }
 
+// Exec overwrites sql.Tx.Exec
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) ExecMapContext(ctx context.Context, query string, mp interface{}) (sql.Result, error) {
+	query, args, err := tx.db.plan(query).mapToSlice(mp)
+	if err != nil {
+		return nil, err
+	}
+	return tx.ExecContext(ctx, query, args...)
+}
+
 func (tx *Tx) ExecMap(query string, mp interface{}) (sql.Result, error) {
 	return tx.ExecMapContext(context.Background(), query, mp)
 }
 
 func (tx *Tx) ExecStructContext(ctx context.Context, query string, st interface{}) (sql.Result, error) {
-	query, args, err := StructToSlice(query, st)
+	query, args, err := tx.db.plan(query).structToSlice(st)
 	if err != nil {
 		return nil, err
 	}
-	return tx.Tx.ExecContext(ctx, query, args...)
+	return tx.ExecContext(ctx, query, args...)
 }
 
 func (tx *Tx) ExecStruct(query string, st interface{}) (sql.Result, error) {
@@ -84,6 +116,10 @@ func (tx *Tx) ExecStruct(query string, st interface{}) (sql.Result, error) {
 }
 
 func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	query, args, err := tx.db.filterArgs(query, args)
+	if err != nil {
+		return nil, err
+	}
 	rows, err := tx.Tx.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
@@ -96,7 +132,7 @@ func (tx *Tx) Query(query string, args ...interface{}) (*Rows, error) {
 }
 
 func (tx *Tx) QueryMapContext(ctx context.Context, query string, mp interface{}) (*Rows, error) {
-	query, args, err := MapToSlice(query, mp)
+	query, args, err := tx.db.plan(query).mapToSlice(mp)
 	if err != nil {
 		return nil, err
 	}
@@ -108,7 +144,7 @@ func (tx *Tx) QueryMap(query string, mp interface{}) (*Rows, error) {
 }
 
 func (tx *Tx) QueryStructContext(ctx context.Context, query string, st interface{}) (*Rows, error) {
-	query, args, err := StructToSlice(query, st)
+	query, args, err := tx.db.plan(query).structToSlice(st)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +165,7 @@ func (tx *Tx) QueryRow(query string, args ...interface{}) *Row {
 }
 
 func (tx *Tx) QueryRowMapContext(ctx context.Context, query string, mp interface{}) *Row {
-	query, args, err := MapToSlice(query, mp)
+	query, args, err := tx.db.plan(query).mapToSlice(mp)
 	if err != nil {
 		return &Row{nil, err}
 	}
@@ -141,7 +177,7 @@ func (tx *Tx) QueryRowMap(query string, mp interface{}) *Row {
 }
 
 func (tx *Tx) QueryRowStructContext(ctx context.Context, query string, st interface{}) *Row {
-	query, args, err := StructToSlice(query, st)
+	query, args, err := tx.db.plan(query).structToSlice(st)
 	if err != nil {
 		return &Row{nil, err}
 	}